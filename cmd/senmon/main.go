@@ -12,6 +12,7 @@ import (
 	"runtime"
 	"time"
 
+	"github.com/lavaorg/dowarp/sensim"
 	"github.com/lavaorg/lrt/mlog"
 	"github.com/lavaorg/warp/warp9"
 )
@@ -21,6 +22,7 @@ var dbglev = flag.Int("d", 0, "debuglevel")
 var addr = flag.String("a", "127.0.0.1:9901", "network address")
 var aname = flag.String("aname", ".", "path on server to use as root")
 var alt = flag.String("alt", "", "alternate reporting address")
+var key = flag.String("key", "", "pre-shared key to authenticate devices with")
 
 func main() {
 
@@ -65,15 +67,22 @@ func handleConnection(c net.Conn) {
 	uid := uint32(0xFFFFFFFF & uint32(os.Getuid()))
 	user := warp9.Identity.User(uid)
 
-	c9, err := warp9.MountConn(c, *aname, 500, user)
+	var c9 *warp9.Clnt
+	var err error
+	if *key != "" {
+		c9, err = sensim.MountConnAuth(c, *aname, 500, user, []byte(*key))
+	} else {
+		c9, err = warp9.MountConn(c, *aname, 500, user)
+	}
 	if err != nil {
 		mlog.Error("Mount failure:%v", err)
 		c.Close()
 		return // end thread
 	}
 
-	// read target sensor
-	readSensor(c9)
+	// identify the device, then read its sensor
+	serial := readInfo(c9, "serial")
+	readSensor(c9, serial)
 
 	// reconfigure the target if necessar
 	if *alt != "" {
@@ -125,7 +134,7 @@ var prf_time time.Duration
 // this shortens the number of requests due to avoiding a
 // last read that just looks for EOF. We have knowledge that
 // the sensors being read is a small number of bytes.
-func readSensor(c9 *warp9.Clnt) {
+func readSensor(c9 *warp9.Clnt, serial string) {
 
 	fid, err := c9.Walk("sensors")
 	if err != nil {
@@ -147,8 +156,27 @@ func readSensor(c9 *warp9.Clnt) {
 	if err != nil {
 		mlog.Error("Error:%v\n", err)
 	} else {
-		mlog.Info("%v", string(buf))
+		mlog.Info("%v: %v", serial, string(buf))
+	}
+}
+
+// read a field of the device's info directory; devices without one
+// are reported as "?".
+func readInfo(c9 *warp9.Clnt, name string) string {
+	fid, err := c9.Walk("info/" + name)
+	if err != nil {
+		return "?"
+	}
+	defer c9.Clunk(fid)
+	err = c9.FOpen(fid, warp9.OREAD)
+	if err != nil {
+		return "?"
+	}
+	buf, err := c9.Read(fid, uint64(0), uint32(100))
+	if err != nil {
+		return "?"
 	}
+	return string(buf)
 }
 
 var reportCount = 0
@@ -7,8 +7,11 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lavaorg/dowarp/sensim"
@@ -21,6 +24,24 @@ var listen = flag.Bool("listen", false, "listen for connections")
 var count = flag.Int("count", 100, "sensor count")
 var life = flag.Int("life", 100, "life span")
 var sleep = flag.Int("sleep", 10, "sleep in sec")
+var scenario = flag.String("scenario", "", "run the fleet described by a scenario file instead of -count/-life/-sleep")
+var key = flag.String("key", "", "pre-shared key collectors must authenticate with")
+var record = flag.String("record", "", "record the sessions relayed between -a and -to in a session file")
+var upstream = flag.String("to", "", "address to relay recorded connections to")
+var replay = flag.String("replay", "", "simulate devices by replaying a session file")
+
+// connection schedule of -count sensors
+var jitter = flag.Float64("jitter", 0, "randomize each sleep by up to this fraction of it")
+var backoff = flag.Duration("backoff", time.Second, "first retry delay after a dial error; doubles on each failure")
+var backoffMax = flag.Duration("backoff-max", time.Minute, "longest retry delay")
+var ramp = flag.Duration("ramp", 0, "spread sensor start-ups over this long")
+var disconnect = flag.Float64("disconnect", 0, "probability a session is dropped early")
+var disconnectWithin = flag.Duration("disconnect-within", 10*time.Second, "dropped sessions end within this long")
+var offline = flag.Float64("offline", 0, "fraction of sensors that go offline for good after a random number of sessions")
+var seed = flag.Int64("seed", 1, "seed for the connection schedules")
+
+// the session replayed by every device, if -replay is given
+var session []*sensim.SessionEntry
 
 type sensor struct {
 	wg    *sync.WaitGroup
@@ -28,57 +49,266 @@ type sensor struct {
 	addr  string
 	life  int
 	sleep int
+	rnd   *rand.Rand
+	stats *sensim.RunStats
 }
 
 func main() {
 	flag.Parse()
-	sensrv := new(sensim.SenSrv)
+	if err := checkFlags(); err != nil {
+		log.Fatal(err)
+	}
+	// beyond 1 a jittered sleep could go negative
+	if *jitter < 0 {
+		*jitter = 0
+	} else if *jitter > 1 {
+		*jitter = 1
+	}
 
-	sensrv.Id = "sensrv"
-	sensrv.Debuglevel = *debug
-	sensrv.Start(sensrv)
-	fmt.Print("sensrv starting\n")
+	if *replay != "" {
+		var err error
+		if session, err = sensim.LoadSession(*replay); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	// serve our object tree
-	if *listen {
-		err := sensrv.StartNetListener("tcp", *addr)
+	if *record != "" {
+		recordSessions(*record, *upstream)
+	} else if *listen {
+		sensrv := newDevice("sensrv")
+		fmt.Print("sensrv starting\n")
+		l, err := net.Listen("tcp", *addr)
+		if err == nil {
+			err = sensrv.ServeListener(l)
+		}
 		if err != nil {
 			log.Println(err)
 		}
+	} else if *scenario != "" {
+		runScenario(*scenario)
 	} else {
-		runSensors(sensrv, *count, *life, *sleep)
+		runSensors(*count, *life, *sleep)
 	}
 
 }
 
+// checkFlags rejects negative durations in the connection schedule
+func checkFlags() error {
+	for _, f := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"backoff", *backoff},
+		{"backoff-max", *backoffMax},
+		{"ramp", *ramp},
+		{"disconnect-within", *disconnectWithin},
+	} {
+		if f.d < 0 {
+			return fmt.Errorf("-%s must not be negative: %v", f.name, f.d)
+		}
+	}
+	if *sleep < 0 {
+		return fmt.Errorf("-sleep must not be negative: %d", *sleep)
+	}
+	return nil
+}
+
 // simulate 'count' (configurable) number of independent sensors
-// make a thread for each sensor; wait for them all to complete
-func runSensors(sensrv *sensim.SenSrv, count, life, sleep int) {
+// make a thread for each sensor, each with its own device instance;
+// wait for them all to complete and print what happened
+func runSensors(count, life, sleep int) {
 
 	var wg sync.WaitGroup
+	stats := &sensim.RunStats{Devices: int64(count)}
 
 	wg.Add(count)
+	fmt.Printf("starting %d sensors\n", count)
 	for ; count > 0; count-- {
-		go sensorMain(sensor{&wg, sensrv, *addr, life, sleep})
+		sensrv := newDevice(fmt.Sprintf("sensor%d", count))
+		rnd := rand.New(rand.NewSource(*seed + int64(count)))
+		go sensorMain(sensor{&wg, sensrv, *addr, life, sleep, rnd, stats})
 	}
 	wg.Wait()
+	fmt.Printf("sensors done: %v\n", stats)
 
 }
 
+// create and start a device: simulated, or replaying -replay;
+// it requires authentication if a key was given
+func newDevice(id string) *sensim.SenSrv {
+	var srv *sensim.SenSrv
+	if *replay != "" {
+		var err error
+		if srv, err = sensim.NewReplaySrv(id, session, *debug); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		srv = sensim.NewSenSrv(id, *debug)
+	}
+	if *key != "" {
+		srv.SetAuthKey([]byte(*key))
+	}
+	srv.Start(srv)
+	return srv
+}
+
+// accept connections on -a and relay each to the upstream address,
+// recording the sessions. The device may be on either side.
+func recordSessions(file, to string) {
+	if to == "" {
+		log.Fatal("-record needs -to")
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	rec := sensim.NewRecorder(f)
+
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("recording %s <-> %s in %s\n", *addr, to, file)
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		up, err := net.Dial("tcp", to)
+		if err != nil {
+			mlog.Error("Dial error:%v", err)
+			c.Close()
+			continue
+		}
+		go func() {
+			if err := rec.Record(c, up); err != nil {
+				mlog.Error("record: %v", err)
+			}
+		}()
+	}
+}
+
+// run the devices of a scenario file against the collector
+func runScenario(file string) {
+	sc, err := sensim.LoadScenario(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if sc.Collector == "" {
+		sc.Collector = *addr
+	}
+	if sc.Key == "" {
+		sc.Key = *key
+	}
+	fmt.Printf("running scenario %s\n", file)
+	stats, err := sc.Run(*debug)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("scenario done: %v\n", stats)
+}
+
 // initiate a connection and then serve our object server on that connection
 // e.g. we will be expecting the server contacted to be a client of our object tree
-// we will then sleep for a configured period and repeast the process
-// we repeast this process for a configured life; then thread ends
+// we will then sleep for a configured period and repeat the process
+// we repeat this process for a configured life; then thread ends.
+// Start-up is staggered over -ramp; a failed dial is retried after a
+// backoff that doubles up to -backoff-max; each dial, failed or not,
+// uses up one unit of life. Sessions may be dropped early (-disconnect)
+// and an -offline fraction of sensors stops early for good.
 func sensorMain(s sensor) {
 
 	defer s.wg.Done()
+	time.Sleep(s.rampDelay())
+	if s.goOffline() {
+		defer atomic.AddInt64(&s.stats.Offline, 1)
+	}
+	retry := *backoff
 	for ; s.life > 0; s.life-- {
+		// wait out a reboot
+		<-s.srv.Up()
+		// the collector may redirect us with the ctl "ip:" command
+		if addr := s.srv.ReportAddr(); addr != "" {
+			s.addr = addr
+		}
 		c, e := net.Dial("tcp", s.addr)
 		if e != nil {
-			mlog.Error("Dial error:%v", e)
-			return
+			atomic.AddInt64(&s.stats.DialErrors, 1)
+			mlog.Error("Dial error:%v; retry in %v", e, retry)
+			time.Sleep(s.jittered(retry))
+			retry = nextRetry(retry)
+			continue
 		}
-		s.srv.NewConnWait(c)
-		time.Sleep(time.Duration(s.sleep) * time.Second)
+		retry = *backoff
+		// a drop due as the session ends on its own is no disconnect
+		var mu sync.Mutex
+		ended := false
+		var drop *time.Timer
+		if after, ok := s.dropAfter(); ok {
+			drop = time.AfterFunc(after, func() {
+				mu.Lock()
+				defer mu.Unlock()
+				if !ended {
+					atomic.AddInt64(&s.stats.Disconnects, 1)
+					c.Close()
+				}
+			})
+		}
+		s.srv.Serve(c)
+		mu.Lock()
+		ended = true
+		if drop != nil {
+			drop.Stop()
+		}
+		mu.Unlock()
+		atomic.AddInt64(&s.stats.Sessions, 1)
+		time.Sleep(s.jittered(time.Duration(s.sleep) * time.Second))
+	}
+}
+
+// rampDelay returns how long to wait before the first dial, spreading
+// start-ups over -ramp
+func (s *sensor) rampDelay() time.Duration {
+	if *ramp <= 0 {
+		return 0
+	}
+	return time.Duration(s.rnd.Int63n(int64(*ramp)))
+}
+
+// goOffline decides if the sensor is one of the -offline fraction;
+// those go offline after a random number of sessions, always fewer
+// than their full life
+func (s *sensor) goOffline() bool {
+	if s.life <= 0 || s.rnd.Float64() >= *offline {
+		return false
+	}
+	s.life = s.rnd.Intn(s.life)
+	return true
+}
+
+// nextRetry returns the delay after retry: double it, up to -backoff-max
+func nextRetry(retry time.Duration) time.Duration {
+	if retry *= 2; retry > *backoffMax {
+		retry = *backoffMax
+	}
+	return retry
+}
+
+// dropAfter decides if a session is dropped early, and when
+func (s *sensor) dropAfter() (time.Duration, bool) {
+	if s.rnd.Float64() >= *disconnect {
+		return 0, false
+	}
+	return time.Duration(s.rnd.Int63n(int64(*disconnectWithin) + 1)), true
+}
+
+// jittered returns d moved randomly by up to -jitter of it either way
+func (s *sensor) jittered(d time.Duration) time.Duration {
+	if *jitter <= 0 {
+		return d
 	}
+	return d + time.Duration((2*s.rnd.Float64()-1)**jitter*float64(d))
 }
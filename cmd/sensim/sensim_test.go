@@ -0,0 +1,168 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package main
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lavaorg/dowarp/sensim"
+)
+
+// setFlags sets the schedule flags for one test, restoring them after.
+func setFlags(t *testing.T, set func()) {
+	j, d, o := *jitter, *disconnect, *offline
+	b, bm, r, dw := *backoff, *backoffMax, *ramp, *disconnectWithin
+	sl := *sleep
+	t.Cleanup(func() {
+		*jitter, *disconnect, *offline = j, d, o
+		*backoff, *backoffMax, *ramp, *disconnectWithin = b, bm, r, dw
+		*sleep = sl
+	})
+	set()
+}
+
+func testSensor(life int) sensor {
+	return sensor{
+		wg:    new(sync.WaitGroup),
+		life:  life,
+		rnd:   rand.New(rand.NewSource(1)),
+		stats: new(sensim.RunStats),
+	}
+}
+
+func TestCheckFlags(t *testing.T) {
+	setFlags(t, func() {})
+	for _, bad := range []*time.Duration{backoff, backoffMax, ramp, disconnectWithin} {
+		*bad = -time.Second
+		if err := checkFlags(); err == nil {
+			t.Errorf("negative duration accepted")
+		}
+		*bad = 0
+		if err := checkFlags(); err != nil {
+			t.Errorf("zero duration: %v", err)
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	setFlags(t, func() {
+		*ramp = time.Minute
+		*backoff, *backoffMax = time.Second, 5*time.Second
+		*jitter = 0.5
+		*disconnect, *disconnectWithin = 0.5, time.Second
+		*offline = 0.5
+	})
+	s := testSensor(10)
+
+	for i := 0; i < 100; i++ {
+		if d := s.rampDelay(); d < 0 || d >= *ramp {
+			t.Fatalf("start-up delay %v outside the ramp", d)
+		}
+		if d := s.jittered(time.Second); d < 500*time.Millisecond || d > 1500*time.Millisecond {
+			t.Fatalf("jittered second %v", d)
+		}
+	}
+
+	var retries []time.Duration
+	for r := *backoff; len(retries) < 5; r = nextRetry(r) {
+		retries = append(retries, r)
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i := range want {
+		if retries[i] != want[i] {
+			t.Fatalf("retry delays %v, want %v", retries, want)
+		}
+	}
+
+	drops := 0
+	for i := 0; i < 1000; i++ {
+		if d, ok := s.dropAfter(); ok {
+			drops++
+			if d < 0 || d > *disconnectWithin {
+				t.Fatalf("drop after %v", d)
+			}
+		}
+	}
+	if drops < 400 || drops > 600 {
+		t.Errorf("%d of 1000 sessions dropped at probability 0.5", drops)
+	}
+
+	offline := 0
+	for i := 0; i < 1000; i++ {
+		s := testSensor(10)
+		s.rnd = rand.New(rand.NewSource(int64(i)))
+		if s.goOffline() {
+			offline++
+			if s.life >= 10 {
+				t.Fatalf("offline sensor keeps a life of %d", s.life)
+			}
+		} else if s.life != 10 {
+			t.Fatalf("online sensor's life cut to %d", s.life)
+		}
+	}
+	if offline < 400 || offline > 600 {
+		t.Errorf("%d of 1000 sensors offline at fraction 0.5", offline)
+	}
+	if s := testSensor(0); s.goOffline() {
+		t.Errorf("sensor without a life went offline")
+	}
+}
+
+// Each failed dial uses up a unit of life.
+func TestSensorDialErrors(t *testing.T) {
+	setFlags(t, func() { *backoff, *backoffMax, *ramp = time.Millisecond, 2*time.Millisecond, 0 })
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := testSensor(3)
+	s.addr = l.Addr().String()
+	l.Close()
+	s.srv = sensim.NewSenSrv("dial", 0)
+	s.srv.Start(s.srv)
+
+	s.wg.Add(1)
+	sensorMain(s)
+	if s.stats.DialErrors != 3 || s.stats.Sessions != 0 {
+		t.Errorf("stats %v; want 3 dial errors", s.stats)
+	}
+}
+
+// Dropped sessions are counted as disconnects, once each.
+func TestSensorDisconnect(t *testing.T) {
+	setFlags(t, func() {
+		*ramp, *sleep = 0, 0
+		*disconnect, *disconnectWithin = 1, 10*time.Millisecond
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// a collector that never says anything
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	s := testSensor(2)
+	s.addr = l.Addr().String()
+	s.srv = sensim.NewSenSrv("drop", 0)
+	s.srv.Start(s.srv)
+
+	s.wg.Add(1)
+	sensorMain(s)
+	if s.stats.Sessions != 2 || s.stats.Disconnects != 2 {
+		t.Errorf("stats %v; want 2 sessions, both dropped", s.stats)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// first file descriptor passed by systemd socket activation
+const listenFdsStart = 3
+
+// listen creates the listener described by addr:
+//
+//	unix:/path/sock   -- unix domain socket; created with mode perm
+//	unix:@name        -- linux abstract unix socket
+//	systemd           -- socket inherited via LISTEN_FDS
+//	host:port         -- tcp
+//
+// The returned cleanup func closes the listener and removes any
+// socket file that was created.
+func listen(addr string, perm os.FileMode) (net.Listener, func(), error) {
+	switch {
+	case addr == "systemd":
+		l, err := inheritedListener()
+		if err != nil {
+			return nil, nil, err
+		}
+		return l, func() { l.Close() }, nil
+
+	case strings.HasPrefix(addr, "unix:@"):
+		l, err := net.Listen("unix", addr[len("unix:"):])
+		if err != nil {
+			return nil, nil, err
+		}
+		return l, func() { l.Close() }, nil
+
+	case strings.HasPrefix(addr, "unix:"):
+		path := addr[len("unix:"):]
+		// remove a stale socket left by an unclean exit; never
+		// remove anything that isn't a socket.
+		if fi, err := os.Lstat(path); err == nil {
+			if fi.Mode()&os.ModeSocket == 0 {
+				return nil, nil, fmt.Errorf("%s exists and is not a socket", path)
+			}
+			os.Remove(path)
+		}
+		// set the umask so the socket is never reachable with
+		// looser permissions than requested.
+		old := syscall.Umask(int(0777 &^ perm.Perm()))
+		l, err := net.Listen("unix", path)
+		syscall.Umask(old)
+		if err != nil {
+			return nil, nil, err
+		}
+		return l, func() {
+			l.Close()
+			os.Remove(path)
+		}, nil
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return l, func() { l.Close() }, nil
+}
+
+// inheritedListener returns the first socket passed by the service
+// manager following the sd_listen_fds(3) protocol.
+func inheritedListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("no sockets passed (LISTEN_PID)")
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds < 1 {
+		return nil, errors.New("no sockets passed (LISTEN_FDS)")
+	}
+	// don't pass the fds on to any children
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	syscall.CloseOnExec(listenFdsStart)
+	f := os.NewFile(uintptr(listenFdsStart), "LISTEN_FD_3")
+	l, err := net.FileListener(f)
+	f.Close() // FileListener dups the descriptor
+	return l, err
+}
@@ -0,0 +1,418 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/lavaorg/dowarp/ufs"
+	"github.com/lavaorg/warp/warp9"
+)
+
+// selftest is the state of one step of the scenario. Each step
+// works in a directory of its own, set up on the host, over a
+// connection of its own, so a failing step leaves the others alone.
+type selftest struct {
+	dir  string // host directory of the step
+	name string // the same directory, as seen by the client
+	addr string
+	c9   *warp9.Clnt
+}
+
+type step struct {
+	name string
+	run  func(t *selftest) error
+}
+
+var testdata = []byte("warp9 ufs selftest\n")
+
+var steps = []step{
+	{"attach", (*selftest).attach},
+	{"create dir", (*selftest).mkdir},
+	{"walk", (*selftest).walk},
+	{"create", (*selftest).create},
+	{"write", (*selftest).write},
+	{"read", (*selftest).read},
+	{"stat", (*selftest).stat},
+	{"wstat chmod", (*selftest).chmod},
+	{"wstat truncate", (*selftest).truncate},
+	{"wstat times", (*selftest).times},
+	{"wstat rename", (*selftest).rename},
+	{"readdir", (*selftest).readdir},
+	{"remove", (*selftest).remove},
+}
+
+// runSelftest serves a temporary directory on a loopback port and
+// drives the scenario through a warp9 client. It returns the exit status.
+func runSelftest() int {
+	dir, err := os.MkdirTemp("", "ufs-selftest-")
+	if err != nil {
+		fmt.Printf("FAIL setup: %v\n", err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	srv := new(ufs.Ufs)
+	srv.Id = "ufs-selftest"
+	srv.Root = dir
+	srv.Debuglevel = *debug
+	srv.Start(srv)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Printf("FAIL setup: %v\n", err)
+		return 1
+	}
+	defer l.Close()
+	go srv.StartListener(l)
+
+	failed := 0
+	for i, s := range steps {
+		if err := runStep(s, dir, fmt.Sprintf("step%d", i), l.Addr().String()); err != nil {
+			fmt.Printf("FAIL %s: %v\n", s.name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("PASS %s\n", s.name)
+	}
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// runStep runs s in a new directory called name in the export.
+func runStep(s step, root, name, addr string) (err error) {
+	t := &selftest{dir: filepath.Join(root, name), name: name, addr: addr}
+	if err := os.Mkdir(t.dir, 0755); err != nil {
+		return err
+	}
+	defer t.close()
+	// a step must not take the others down with it
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	if s.name != "attach" {
+		if err := t.attach(); err != nil {
+			return fmt.Errorf("attach: %v", err)
+		}
+	}
+	return s.run(t)
+}
+
+func (t *selftest) close() {
+	if t.c9 != nil {
+		t.c9.Clunk(t.c9.Root)
+		t.c9.Unmount()
+	}
+}
+
+// path is name within the step's directory, as seen by the client.
+func (t *selftest) path(name string) string {
+	return t.name + "/" + name
+}
+
+// host is name within the step's directory on the host.
+func (t *selftest) host(name string) string {
+	return filepath.Join(t.dir, name)
+}
+
+// file creates a file holding testdata on the host.
+func (t *selftest) file(name string) error {
+	return os.WriteFile(t.host(name), testdata, 0644)
+}
+
+// nullDir returns a Dir that leaves every field unchanged by Wstat.
+func nullDir() *warp9.Dir {
+	return &warp9.Dir{
+		Mode:   0xFFFFFFFF,
+		Atime:  ^uint32(0),
+		Mtime:  ^uint32(0),
+		Length: ^uint64(0),
+		Uid:    warp9.NOUID,
+		Gid:    warp9.NOUID,
+		Muid:   warp9.NOUID,
+	}
+}
+
+// wstat applies d to name, with the object open as wstats on open
+// files are the usual case.
+func (t *selftest) wstat(name string, d *warp9.Dir) (*warp9.Dir, error) {
+	obj, err := t.c9.Open(t.path(name), warp9.OREAD)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	if err := t.fwstat(obj.Fid, d); err != nil {
+		return nil, err
+	}
+	return t.c9.FStat(obj.Fid)
+}
+
+// fwstat sends a Twstat for fid. It packs the message itself, as
+// Clnt.FWstat leaves the stat out of the message size.
+func (t *selftest) fwstat(fid *warp9.Fid, d *warp9.Dir) error {
+	stat := warp9.PackDir(d)
+	pkt := make([]byte, 7+4+2+len(stat))
+	binary.LittleEndian.PutUint32(pkt, uint32(len(pkt)))
+	pkt[4] = warp9.Twstat // the tag is set by Rpc
+	binary.LittleEndian.PutUint32(pkt[7:], fid.Fid)
+	binary.LittleEndian.PutUint16(pkt[11:], uint16(len(stat)))
+	copy(pkt[13:], stat)
+
+	tc := t.c9.NewFcall()
+	tc.Type, tc.Fid, tc.Pkt = warp9.Twstat, fid.Fid, pkt
+	_, err := t.c9.Rpc(tc)
+	return err
+}
+
+func (t *selftest) attach() error {
+	user := warp9.Identity.User(uint32(os.Getuid()))
+	c9, err := warp9.Mount("tcp", t.addr, "/", 8192, user)
+	if err != nil {
+		return err
+	}
+	t.c9 = c9
+	if c9.Root.Qid.Type&warp9.QTDIR == 0 {
+		return fmt.Errorf("root qid type %x, want directory", c9.Root.Qid.Type)
+	}
+	return nil
+}
+
+func (t *selftest) mkdir() error {
+	obj, err := t.c9.Create(t.path("sub"), warp9.DMDIR|0755, warp9.OREAD)
+	if err != nil {
+		return err
+	}
+	obj.Close()
+	fi, err := os.Stat(t.host("sub"))
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("sub is not a directory")
+	}
+	return nil
+}
+
+func (t *selftest) walk() error {
+	if err := os.Mkdir(t.host("sub"), 0755); err != nil {
+		return err
+	}
+	fid, err := t.c9.Walk(t.path("sub"))
+	if err != nil {
+		return err
+	}
+	defer t.c9.Clunk(fid)
+	if fid.Qid.Type&warp9.QTDIR == 0 {
+		return fmt.Errorf("qid type %x, want directory", fid.Qid.Type)
+	}
+	if fid, err = t.c9.Walk(t.path("sub/missing")); err == nil {
+		t.c9.Clunk(fid)
+		return fmt.Errorf("walk to missing object succeeded")
+	}
+	return nil
+}
+
+func (t *selftest) create() error {
+	obj, err := t.c9.Create(t.path("file"), 0644, warp9.ORDWR)
+	if err != nil {
+		return err
+	}
+	obj.Close()
+	fi, err := os.Stat(t.host("file"))
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Perm() != 0644 {
+		return fmt.Errorf("mode %o, want 644", fi.Mode().Perm())
+	}
+	return nil
+}
+
+func (t *selftest) write() error {
+	if err := os.WriteFile(t.host("file"), nil, 0644); err != nil {
+		return err
+	}
+	obj, err := t.c9.Open(t.path("file"), warp9.OWRITE)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	n, err := obj.WriteAt(testdata, 0)
+	if err != nil {
+		return err
+	}
+	if n != len(testdata) {
+		return fmt.Errorf("wrote %d of %d bytes", n, len(testdata))
+	}
+	b, err := os.ReadFile(t.host("file"))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(b, testdata) {
+		return fmt.Errorf("file holds %q, want %q", b, testdata)
+	}
+	return nil
+}
+
+func (t *selftest) read() error {
+	if err := t.file("file"); err != nil {
+		return err
+	}
+	obj, err := t.c9.Open(t.path("file"), warp9.OREAD)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	buf := make([]byte, 100)
+	n, err := obj.ReadAt(buf, 0)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(buf[:n], testdata) {
+		return fmt.Errorf("read %q, want %q", buf[:n], testdata)
+	}
+	return nil
+}
+
+func (t *selftest) stat() error {
+	if err := t.file("file"); err != nil {
+		return err
+	}
+	d, err := t.c9.Stat(t.path("file"))
+	if err != nil {
+		return err
+	}
+	if d.Name != "file" || d.Length != uint64(len(testdata)) {
+		return fmt.Errorf("got name %q length %d", d.Name, d.Length)
+	}
+	return nil
+}
+
+func (t *selftest) chmod() error {
+	if err := t.file("file"); err != nil {
+		return err
+	}
+	d := nullDir()
+	d.Mode = 0600
+	st, err := t.wstat("file", d)
+	if err != nil {
+		return err
+	}
+	if st.Mode&0777 != 0600 {
+		return fmt.Errorf("mode %o, want 600", st.Mode&0777)
+	}
+	return nil
+}
+
+func (t *selftest) truncate() error {
+	if err := t.file("file"); err != nil {
+		return err
+	}
+	d := nullDir()
+	d.Length = 5
+	st, err := t.wstat("file", d)
+	if err != nil {
+		return err
+	}
+	if st.Length != 5 {
+		return fmt.Errorf("length %d, want 5", st.Length)
+	}
+	return nil
+}
+
+func (t *selftest) times() error {
+	const atime, mtime = 1000000000, 1100000000
+	if err := t.file("file"); err != nil {
+		return err
+	}
+	d := nullDir()
+	d.Atime = atime
+	d.Mtime = mtime
+	st, err := t.wstat("file", d)
+	if err != nil {
+		return err
+	}
+	if st.Mtime != mtime {
+		return fmt.Errorf("mtime %d, want %d", st.Mtime, mtime)
+	}
+	if st.Atime != atime {
+		return fmt.Errorf("atime %d, want %d", st.Atime, atime)
+	}
+	return nil
+}
+
+func (t *selftest) rename() error {
+	if err := t.file("file"); err != nil {
+		return err
+	}
+	d := nullDir()
+	d.Name = "renamed"
+	if _, err := t.wstat("file", d); err != nil {
+		return err
+	}
+	if _, err := t.c9.Stat(t.path("renamed")); err != nil {
+		return err
+	}
+	if _, err := os.Stat(t.host("file")); err == nil {
+		return fmt.Errorf("old name still exists")
+	}
+	return nil
+}
+
+func (t *selftest) readdir() error {
+	for _, name := range []string{"a", "b"} {
+		if err := t.file(name); err != nil {
+			return err
+		}
+	}
+	obj, err := t.c9.Open(t.name, warp9.OREAD)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	dirs, err := obj.Readdir(0)
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for _, d := range dirs {
+		names = append(names, d.Name)
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "a" || names[1] != "b" {
+		return fmt.Errorf("listing %v, want [a b]", names)
+	}
+	return nil
+}
+
+func (t *selftest) remove() error {
+	if err := os.Mkdir(t.host("sub"), 0755); err != nil {
+		return err
+	}
+	if err := t.file("sub/file"); err != nil {
+		return err
+	}
+	if err := t.c9.Remove(t.path("sub/file")); err != nil {
+		return err
+	}
+	if err := t.c9.Remove(t.path("sub")); err != nil {
+		return err
+	}
+	if _, err := os.Stat(t.host("sub")); err == nil {
+		return fmt.Errorf("sub still exists")
+	}
+	return nil
+}
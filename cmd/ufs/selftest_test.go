@@ -0,0 +1,13 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package main
+
+import "testing"
+
+// The self-test passes against this build of the server.
+func TestSelftest(t *testing.T) {
+	if status := runSelftest(); status != 0 {
+		t.Fatalf("selftest exit status %d", status)
+	}
+}
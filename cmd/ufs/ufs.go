@@ -8,31 +8,119 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/lavaorg/dowarp/ufs"
 	"github.com/lavaorg/warp/warp9"
 )
 
-var addr = flag.String("addr", ":5640", "network address")
+var addr = flag.String("addr", ":5640", "network address (host:port, unix:/path, unix:@name or systemd)")
 var debug = flag.Int("debug", 0, "print debug messages")
 var root = flag.String("root", "/", "root filesystem")
+var snapdir = flag.String("snapdir", "", "directory for snapshot views (default: system temp)")
+var snapmax = flag.Int64("snapmax", ufs.DefaultSnapMax, "bytes of file data a snapshot view may hold (-1: no limit)")
+var sockmode = flag.String("sockmode", "0600", "permissions of a unix socket file")
+var readonly = flag.Bool("readonly", false, "refuse all modifications")
+var config = flag.String("config", "", "JSON export config (root, readonly, allow); reloaded on SIGHUP")
+var grace = flag.Duration("grace", 10*time.Second, "time allowed for outstanding requests at shutdown")
+var selftestFlag = flag.Bool("selftest", false, "exercise a server on a temporary export and report pass/fail")
 
 func main() {
 	flag.Parse()
-	ufs := new(ufs.Ufs)
-	showInterfaces(ufs)
+	if *selftestFlag {
+		os.Exit(runSelftest())
+	}
+
+	srv := new(ufs.Ufs)
+	showInterfaces(srv)
+
+	perm, err := strconv.ParseUint(*sockmode, 8, 32)
+	if err != nil {
+		log.Fatalf("bad sockmode: %v", err)
+	}
 
-	ufs.Id = "ufs"
-	ufs.Root = *root
-	ufs.Debuglevel = *debug
-	ufs.Start(ufs)
+	srv.Id = "ufs"
+	srv.SnapDir = *snapdir
+	srv.SnapMax = *snapmax
+	srv.Debuglevel = *debug
+	cfg := flagConfig()
+	if *config != "" {
+		cfg, err = ufs.LoadConfig(*config, cfg)
+	} else {
+		err = cfg.Check()
+	}
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	srv.Reconfigure(cfg)
+	srv.Start(srv)
 	fmt.Print("ufs starting\n")
 	// determined by build tags
 	//extraFuncs()
-	err := ufs.StartNetListener("tcp", *addr)
+	l, cleanup, err := listen(*addr, os.FileMode(perm))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// SIGHUP reloads the config; SIGINT/SIGTERM stop accepting,
+	// drain outstanding requests and remove the socket file.
+	sigs := make(chan os.Signal, 1)
+	stopping := make(chan bool)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for sig := range sigs {
+			if sig == syscall.SIGHUP {
+				reload(srv)
+				continue
+			}
+			close(stopping)
+			cleanup()
+			if err := srv.Shutdown(*grace); err != nil {
+				log.Println(err)
+			}
+			os.Exit(0)
+		}
+	}()
+
+	err = srv.StartListener(l)
+	select {
+	case <-stopping:
+		select {} // the signal handler drains and exits
+	default:
+	}
 	if err != nil {
 		log.Println(err)
 	}
+	cleanup()
+}
+
+func reload(srv *ufs.Ufs) {
+	if *config == "" {
+		log.Println("SIGHUP: no config file to reload")
+		return
+	}
+	cfg, err := ufs.LoadConfig(*config, flagConfig())
+	if err != nil {
+		log.Printf("SIGHUP: keeping current config: %v", err)
+		return
+	}
+	srv.Reconfigure(cfg)
+	log.Printf("SIGHUP: reloaded %s", *config)
+}
+
+// flagConfig is the export config given on the command line; a
+// config file overrides it setting by setting.
+func flagConfig() *ufs.Config {
+	r, err := filepath.Abs(*root)
+	if err != nil {
+		r = *root
+	}
+	return &ufs.Config{Root: r, ReadOnly: *readonly}
 }
 
 func showInterfaces(ifaces interface{}) {
@@ -0,0 +1,238 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package sensim
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lavaorg/warp/warp9"
+)
+
+// ActuatorSpec describes an actuator object:
+//
+//	relay    -- on or off (also 1/0, true/false)
+//	dimmer   -- a level of 0..100 percent
+//	setpoint -- a value within Min..Max (unbounded if Max <= Min)
+//
+// A written value is validated at once but takes effect Delay later
+// on the device clock; until then reads return the previous state.
+// Track models follow an actuator's state (see Track).
+type ActuatorSpec struct {
+	Path    string   `json:"path"`
+	Kind    string   `json:"kind"`
+	Min     float64  `json:"min"`
+	Max     float64  `json:"max"`
+	Initial float64  `json:"initial"`
+	Delay   Duration `json:"delay"`
+}
+
+// actuatorItem is a writable object whose state feeds back into
+// linked sensor models.
+type actuatorItem struct {
+	sync.Mutex
+	dev     *SenSrv
+	spec    ActuatorSpec
+	state   float64
+	target  float64   // last value written
+	due     time.Time // when target takes effect
+	pending bool
+	changed time.Time // when the state last changed
+	prev    float64   // the state before then
+}
+
+func (spec *ActuatorSpec) check() error {
+	switch spec.Kind {
+	case "relay", "dimmer", "setpoint":
+	default:
+		return fmt.Errorf("unknown actuator: %q", spec.Kind)
+	}
+	if spec.Delay < 0 {
+		return fmt.Errorf("delay must not be negative")
+	}
+	return nil
+}
+
+// AddActuator adds an actuator object at spec.Path.
+func (srv *SenSrv) AddActuator(spec *ActuatorSpec) error {
+	if err := spec.check(); err != nil {
+		return err
+	}
+	_, err := srv.addItem(spec.Path, func(sdir *SenDir) (*SenDir, error) {
+		a := &actuatorItem{dev: srv, spec: *spec, state: spec.Initial}
+		if _, err := a.parse(a.format(spec.Initial)); err != nil {
+			return nil, fmt.Errorf("initial: %v", err)
+		}
+		sdir.Mode = uint32(perms(warp9.DMREAD|warp9.DMWRITE, warp9.DMREAD|warp9.DMWRITE, warp9.DMREAD))
+		sdir.item = a
+		return sdir, nil
+	})
+	return err
+}
+
+// parse validates a written value.
+func (a *actuatorItem) parse(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	switch a.spec.Kind {
+	case "relay":
+		switch strings.ToLower(s) {
+		case "on", "1", "true":
+			return 1, nil
+		case "off", "0", "false":
+			return 0, nil
+		}
+		return 0, fmt.Errorf("relay: want on or off: %q", s)
+	case "dimmer":
+		v, err := strconv.Atoi(strings.TrimSuffix(s, "%"))
+		if err != nil || v < 0 || v > 100 {
+			return 0, fmt.Errorf("dimmer: want 0..100: %q", s)
+		}
+		return float64(v), nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("setpoint: %v", err)
+	}
+	if a.spec.Max > a.spec.Min && (v < a.spec.Min || v > a.spec.Max) {
+		return 0, fmt.Errorf("setpoint: %g not within %g..%g", v, a.spec.Min, a.spec.Max)
+	}
+	return v, nil
+}
+
+func (a *actuatorItem) format(v float64) string {
+	switch a.spec.Kind {
+	case "relay":
+		if v != 0 {
+			return "on"
+		}
+		return "off"
+	case "dimmer":
+		return strconv.Itoa(int(v))
+	}
+	return fmt.Sprintf("%f", v)
+}
+
+// write requests a new state, superseding any change still pending.
+func (a *actuatorItem) write(data []byte) error {
+	v, err := a.parse(string(data))
+	if err != nil {
+		return err
+	}
+	now := a.dev.Clock().Now()
+
+	a.Lock()
+	defer a.Unlock()
+	a.settle(now)
+	a.target = v
+	a.due = now.Add(time.Duration(a.spec.Delay))
+	a.pending = true
+	a.settle(now)
+	return nil
+}
+
+// settle applies a pending change that is due. Called with a locked.
+func (a *actuatorItem) settle(now time.Time) {
+	if a.pending && !now.Before(a.due) {
+		a.prev, a.state = a.state, a.target
+		a.pending = false
+		a.changed = a.due
+	}
+}
+
+// restart applies any pending change at once; the device clock has
+// been replaced and due times no longer mean anything.
+func (a *actuatorItem) restart() {
+	a.Lock()
+	if a.pending {
+		a.state = a.target
+		a.pending = false
+	}
+	a.changed = time.Time{}
+	a.Unlock()
+}
+
+// value returns the state in effect at time t. Models catching up
+// may ask for times before the last change, when the previous state
+// was still in effect.
+func (a *actuatorItem) value(t time.Time) float64 {
+	a.Lock()
+	defer a.Unlock()
+	switch {
+	case a.pending && !t.Before(a.due):
+		return a.target
+	case t.Before(a.changed):
+		return a.prev
+	}
+	return a.state
+}
+
+// Level is the actuator's state as a model Input: 0 or 1 for a
+// relay, 0..1 for a dimmer and the value itself for a setpoint.
+func (a *actuatorItem) Level(t time.Time) float64 {
+	v := a.value(t)
+	if a.spec.Kind == "dimmer" {
+		v /= 100
+	}
+	return v
+}
+
+func (a *actuatorItem) Stat(dir *SenDir) error {
+	now := a.dev.Clock().Now()
+	a.Lock()
+	defer a.Unlock()
+	a.settle(now)
+	dir.Length = uint64(len(a.format(a.state)))
+	if !a.changed.IsZero() {
+		dir.Mtime = uint32(a.changed.Unix())
+	}
+	return nil
+}
+
+func (a *actuatorItem) Read() ([]byte, error) {
+	return []byte(a.format(a.value(a.dev.Clock().Now()))), nil
+}
+
+// Open serves reads as an Item; each write requests a new state.
+func (a *actuatorItem) Open(dir *SenDir, mode uint8) (Handle, error) {
+	return openItem(a, func(data []byte, off uint64) error { return a.write(data) })
+}
+
+func (a *actuatorItem) String() string {
+	now := a.dev.Clock().Now()
+	a.Lock()
+	defer a.Unlock()
+	a.settle(now)
+	s := fmt.Sprintf("(%s state:%s", a.spec.Kind, a.format(a.state))
+	if a.pending {
+		s += fmt.Sprintf(" target:%s in:%v", a.format(a.target), a.due.Sub(now))
+	}
+	return s + ")"
+}
+
+// input finds the actuator at path for a Track model.
+func (srv *SenSrv) input(path string) (Input, error) {
+	if d := srv.lookup(path); d != nil {
+		if a, ok := d.item.(*actuatorItem); ok {
+			return a, nil
+		}
+	}
+	return nil, fmt.Errorf("no actuator: %s", path)
+}
+
+// actuators lists "path state" for every actuator.
+func cmdActuators(srv *SenSrv, args string) (string, error) {
+	var s []string
+	srv.each(func(d *SenDir) {
+		if a, ok := d.item.(*actuatorItem); ok {
+			s = append(s, srv.pathOf(d)+a.String())
+		}
+	})
+	if len(s) == 0 {
+		return "no actuators", nil
+	}
+	return strings.Join(s, " "), nil
+}
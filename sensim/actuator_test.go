@@ -0,0 +1,55 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package sensim
+
+import (
+	"testing"
+	"time"
+)
+
+// Samples taken after a change settled, for times before it, see
+// the state then in effect.
+func TestActuatorBackfill(t *testing.T) {
+	t0 := time.Unix(1000, 0)
+	vc := NewVirtualClock(t0)
+	srv := NewSenSrv("act", 0)
+	srv.SetClock(vc)
+	spec := &ActuatorSpec{Path: "heater", Kind: "setpoint", Min: 5, Max: 30, Initial: 18, Delay: Duration(30 * time.Second)}
+	if err := srv.AddActuator(spec); err != nil {
+		t.Fatal(err)
+	}
+	s, err := srv.configureSensor("temp", &ModelSpec{Type: "track", Input: "heater", Gain: 1}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.reading()
+
+	a := srv.lookup("heater").item.(*actuatorItem)
+	if err := a.write([]byte("28")); err != nil {
+		t.Fatal(err)
+	}
+	vc.Advance(time.Minute)
+	if _, err := srv.lookup("heater").stat(); err != nil { // settles the change
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		at   time.Duration
+		want float64
+	}{{10 * time.Second, 18}, {29 * time.Second, 18}, {30 * time.Second, 28}, {time.Minute, 28}} {
+		if got := a.value(t0.Add(tc.at)); got != tc.want {
+			t.Errorf("value at %v: %g, want %g", tc.at, got, tc.want)
+		}
+	}
+
+	// the sensor catches up only now
+	for _, r := range s.history(0, 100) {
+		want := 18.0
+		if !r.Time.Before(t0.Add(30 * time.Second)) {
+			want = 28
+		}
+		if r.Value != want {
+			t.Errorf("reading at %v: %g, want %g", r.Time.Sub(t0), r.Value, want)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package sensim
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/lavaorg/warp/warp9"
+)
+
+// Authentication. A device with a key (SetAuthKey) only accepts
+// attaches whose afid has completed a challenge/response exchange
+// that proves both sides hold the same pre-shared key:
+//
+//	collector writes  <collector nonce>
+//	collector reads   <device nonce> <device proof>
+//	collector writes  <collector proof>
+//
+// after which reads of the afid return "ok".
+// Nonces are 16 random bytes and proofs are HMAC-SHA256 of the role
+// ("device" or "collector") and both nonces, all in hex. The
+// collector checks the device proof before answering, so neither
+// side learns anything useful from talking to an impostor.
+// Collectors use MountConnAuth. A device without a key needs no
+// authentication and refuses to start it.
+
+const nonceLen = 16
+
+var errAuth = errors.New("authentication failed")
+
+// authState is the progress of one afid's exchange.
+type authState struct {
+	sync.Mutex
+	dnonce []byte // device nonce
+	cnonce []byte // collector nonce, once written
+	done   bool
+}
+
+// SetAuthKey sets the pre-shared key collectors must prove they
+// hold; nil turns authentication off.
+func (srv *SenSrv) SetAuthKey(key []byte) {
+	srv.mu.Lock()
+	srv.key = key
+	srv.mu.Unlock()
+}
+
+func (srv *SenSrv) authKey() []byte {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.key
+}
+
+// authProof is the proof role gives for the exchange.
+func authProof(key []byte, role string, dnonce, cnonce []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(role))
+	m.Write(dnonce)
+	m.Write(cnonce)
+	return m.Sum(nil)
+}
+
+func newNonce() ([]byte, error) {
+	n := make([]byte, nonceLen)
+	_, err := rand.Read(n)
+	return n, err
+}
+
+func (srv *SenSrv) AuthInit(afid *warp9.SrvFid, aname string) (*warp9.Qid, error) {
+	if srv.authKey() == nil {
+		return nil, warp9.Error(warp9.Enoauth)
+	}
+	n, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	afid.Aux = &authState{dnonce: n}
+
+	srv.mu.Lock()
+	qid := warp9.Qid{Type: warp9.QTAUTH, Path: srv.qidp}
+	srv.qidp++
+	srv.mu.Unlock()
+	return &qid, nil
+}
+
+func (srv *SenSrv) AuthDestroy(afid *warp9.SrvFid) {
+	afid.Aux = nil
+}
+
+// AuthCheck admits an attach on a device without a key, or with an
+// afid that completed the exchange for the same user.
+func (srv *SenSrv) AuthCheck(fid *warp9.SrvFid, afid *warp9.SrvFid, aname string) error {
+	if srv.authKey() == nil {
+		return nil
+	}
+	if afid == nil || afid.User != fid.User {
+		log.Printf("%s: attach without authentication\n", srv.Id)
+		return errAuth
+	}
+	as, ok := afid.Aux.(*authState)
+	if !ok {
+		return errAuth
+	}
+	as.Lock()
+	defer as.Unlock()
+	if !as.done {
+		return errAuth
+	}
+	return nil
+}
+
+func (srv *SenSrv) AuthRead(afid *warp9.SrvFid, offset uint64, data []byte) (int, error) {
+	as, ok := afid.Aux.(*authState)
+	if !ok {
+		return 0, errAuth
+	}
+	as.Lock()
+	defer as.Unlock()
+
+	var msg string
+	switch {
+	case as.done:
+		msg = "ok\n"
+	case as.cnonce != nil:
+		proof := authProof(srv.authKey(), "device", as.dnonce, as.cnonce)
+		msg = fmt.Sprintf("%x %x\n", as.dnonce, proof)
+	default:
+		return 0, errors.New("auth: collector nonce not written")
+	}
+	if offset >= uint64(len(msg)) {
+		return 0, nil
+	}
+	return copy(data, msg[offset:]), nil
+}
+
+func (srv *SenSrv) AuthWrite(afid *warp9.SrvFid, offset uint64, data []byte) (int, error) {
+	as, ok := afid.Aux.(*authState)
+	if !ok {
+		return 0, errAuth
+	}
+	b, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, err
+	}
+	as.Lock()
+	defer as.Unlock()
+
+	switch {
+	case as.done:
+		return 0, errors.New("auth: already done")
+	case as.cnonce == nil:
+		if len(b) != nonceLen {
+			return 0, errors.New("auth: bad nonce")
+		}
+		as.cnonce = b
+	default:
+		want := authProof(srv.authKey(), "collector", as.dnonce, as.cnonce)
+		if !hmac.Equal(b, want) {
+			log.Printf("%s: collector failed authentication\n", srv.Id)
+			return 0, errAuth
+		}
+		as.done = true
+	}
+	return len(data), nil
+}
+
+// Authenticate runs the collector side of the exchange with a device
+// on a new afid, and returns the afid to attach with. It fails if the
+// device does not prove it holds key.
+func Authenticate(clnt *warp9.Clnt, user warp9.User, aname string, key []byte) (*warp9.Fid, error) {
+	afid, err := clnt.Auth(user, aname)
+	if err != nil {
+		return nil, err
+	}
+	if err := authenticate(clnt, afid, key); err != nil {
+		clnt.Clunk(afid)
+		return nil, err
+	}
+	return afid, nil
+}
+
+func authenticate(clnt *warp9.Clnt, afid *warp9.Fid, key []byte) error {
+	cnonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	if _, err := clnt.Write(afid, []byte(hex.EncodeToString(cnonce)), 0); err != nil {
+		return err
+	}
+	b, err := clnt.Read(afid, 0, 256)
+	if err != nil {
+		return err
+	}
+	f := strings.Fields(string(b))
+	if len(f) != 2 {
+		return fmt.Errorf("auth: bad challenge %q", b)
+	}
+	dnonce, err1 := hex.DecodeString(f[0])
+	proof, err2 := hex.DecodeString(f[1])
+	if err1 != nil || err2 != nil || len(dnonce) != nonceLen || bytes.Equal(dnonce, cnonce) {
+		return fmt.Errorf("auth: bad challenge %q", b)
+	}
+	if !hmac.Equal(proof, authProof(key, "device", dnonce, cnonce)) {
+		return errors.New("auth: device failed authentication")
+	}
+
+	proof = authProof(key, "collector", dnonce, cnonce)
+	if _, err := clnt.Write(afid, []byte(hex.EncodeToString(proof)), 0); err != nil {
+		return err
+	}
+	return nil
+}
+
+// MountConnAuth is warp9.MountConn for devices that require
+// authentication: it authenticates with key before attaching.
+func MountConnAuth(c net.Conn, aname string, msize uint32, user warp9.User, key []byte) (*warp9.Clnt, error) {
+	clnt, err := warp9.Connect(c, msize+warp9.IOHDRSZ)
+	if err != nil {
+		return nil, err
+	}
+
+	afid, err := Authenticate(clnt, user, aname, key)
+	if err != nil {
+		clnt.Unmount()
+		return nil, err
+	}
+	fid, err := clnt.Attach(afid, user, aname)
+	clnt.Clunk(afid)
+	if err != nil {
+		clnt.Unmount()
+		return nil, err
+	}
+
+	clnt.Root = fid
+	return clnt, nil
+}
@@ -0,0 +1,56 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package sensim
+
+import (
+	"net"
+	"testing"
+
+	"github.com/lavaorg/warp/warp9"
+)
+
+func TestAuth(t *testing.T) {
+	srv := NewSenSrv("auth", 0)
+	srv.SetAuthKey([]byte("secret"))
+	addr := start(t, srv)
+	user := warp9.Identity.User(501)
+
+	for _, tc := range []struct {
+		key string
+		ok  bool
+	}{{"secret", true}, {"guess", false}} {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c9, err := MountConnAuth(c, "/", 8192, user, []byte(tc.key))
+		if (err == nil) != tc.ok {
+			t.Errorf("key %q: mount %v", tc.key, err)
+		}
+		if err == nil {
+			if _, err := c9.Stat("sensors"); err != nil {
+				t.Errorf("key %q: %v", tc.key, err)
+			}
+			c9.Unmount()
+		}
+		c.Close()
+	}
+}
+
+// Reads of the afid honour the offset, so a reader looping to EOF
+// stops.
+func TestAuthReadOffset(t *testing.T) {
+	srv := NewSenSrv("auth", 0)
+	afid := &warp9.SrvFid{Aux: &authState{done: true}}
+	for _, tc := range []struct {
+		off  uint64
+		want string
+	}{{0, "ok\n"}, {2, "\n"}, {3, ""}, {100, ""}} {
+		buf := make([]byte, 100)
+		n, err := srv.AuthRead(afid, tc.off, buf)
+		if err != nil || string(buf[:n]) != tc.want {
+			t.Errorf("read at %d: %q, %v; want %q", tc.off, buf[:n], err, tc.want)
+		}
+	}
+}
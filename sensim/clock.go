@@ -0,0 +1,192 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package sensim
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the time source of a simulated device. Sensors sample on
+// their interval as measured by the clock.
+type Clock interface {
+	Now() time.Time
+	// After delivers the clock's time once d has passed on it.
+	After(d time.Duration) <-chan time.Time
+	// Advance moves the clock forward by d (fast-forward).
+	Advance(d time.Duration)
+}
+
+// Stopper is implemented by clocks that can release a pending After
+// before it fires, e.g. when its reader gives up waiting.
+type Stopper interface {
+	Stop(ch <-chan time.Time)
+}
+
+// stop releases ch if c can.
+func stop(c Clock, ch <-chan time.Time) {
+	if s, ok := c.(Stopper); ok {
+		s.Stop(ch)
+	}
+}
+
+// WallClock follows real time, shifted by any amount it was advanced.
+type WallClock struct {
+	mu      sync.Mutex
+	offset  time.Duration
+	waiters map[<-chan time.Time]*wallWaiter
+}
+
+type wallWaiter struct {
+	when  time.Time // on the clock
+	ch    chan time.Time
+	timer *time.Timer
+}
+
+func (c *WallClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now()
+}
+
+// now is the clock's time. Called with c locked.
+func (c *WallClock) now() time.Time {
+	return time.Now().Add(c.offset)
+}
+
+func (c *WallClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	w := &wallWaiter{when: c.now().Add(d), ch: make(chan time.Time, 1)}
+	if c.waiters == nil {
+		c.waiters = make(map[<-chan time.Time]*wallWaiter)
+	}
+	c.waiters[w.ch] = w
+	w.timer = time.AfterFunc(d, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.waiters[w.ch] == w {
+			delete(c.waiters, w.ch)
+			w.ch <- c.now()
+		}
+	})
+	return w.ch
+}
+
+// Advance moves the clock forward, waking every waiter now due and
+// shortening the wait of the others.
+func (c *WallClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.offset += d
+	now := c.now()
+	for ch, w := range c.waiters {
+		if !w.timer.Stop() {
+			continue // firing; it is waiting for the lock
+		}
+		if left := w.when.Sub(now); left > 0 {
+			w.timer.Reset(left)
+			continue
+		}
+		delete(c.waiters, ch)
+		w.ch <- now
+	}
+}
+
+func (c *WallClock) Stop(ch <-chan time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if w, ok := c.waiters[ch]; ok {
+		w.timer.Stop()
+		delete(c.waiters, ch)
+	}
+}
+
+// VirtualClock only moves when advanced; for deterministic tests.
+type VirtualClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []waiter
+}
+
+type waiter struct {
+	when time.Time
+	ch   chan time.Time
+}
+
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+func (c *VirtualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *VirtualClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, waiter{c.now.Add(d), ch})
+	sort.Slice(c.waiters, func(i, j int) bool { return c.waiters[i].when.Before(c.waiters[j].when) })
+	return ch
+}
+
+// Advance moves time forward and wakes every waiter that is due.
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	i := 0
+	for ; i < len(c.waiters) && !c.waiters[i].when.After(c.now); i++ {
+		c.waiters[i].ch <- c.now
+	}
+	c.waiters = c.waiters[i:]
+}
+
+func (c *VirtualClock) Stop(ch <-chan time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, w := range c.waiters {
+		if (<-chan time.Time)(w.ch) == ch {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// Clock returns the device's time source.
+func (srv *SenSrv) Clock() Clock {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.clock
+}
+
+// SetClock replaces the device's time source. Sensors restart their
+// sampling at their next read.
+func (srv *SenSrv) SetClock(c Clock) {
+	srv.mu.Lock()
+	srv.clock = c
+	srv.boot = c.Now()
+	srv.mu.Unlock()
+
+	srv.each(func(d *SenDir) {
+		switch it := d.item.(type) {
+		case *sensorItem:
+			it.restart()
+		case *actuatorItem:
+			it.restart()
+		}
+	})
+}
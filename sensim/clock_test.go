@@ -0,0 +1,148 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package sensim
+
+import (
+	"testing"
+	"time"
+)
+
+// received returns the time sent on ch, or false if nothing was.
+func received(ch <-chan time.Time) (time.Time, bool) {
+	select {
+	case t := <-ch:
+		return t, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func TestVirtualClock(t *testing.T) {
+	t0 := time.Unix(1000, 0)
+	vc := NewVirtualClock(t0)
+
+	if _, ok := received(vc.After(0)); !ok {
+		t.Errorf("After(0) did not fire at once")
+	}
+	late := vc.After(2 * time.Second)
+	soon := vc.After(time.Second)
+	vc.Advance(999 * time.Millisecond)
+	if _, ok := received(soon); ok {
+		t.Errorf("fired before it was due")
+	}
+	vc.Advance(time.Millisecond)
+	if got, ok := received(soon); !ok || !got.Equal(t0.Add(time.Second)) {
+		t.Errorf("due waiter got %v, %v; want %v", got, ok, t0.Add(time.Second))
+	}
+	if _, ok := received(late); ok {
+		t.Errorf("later waiter fired early")
+	}
+	vc.Advance(time.Hour)
+	if _, ok := received(late); !ok {
+		t.Errorf("later waiter did not fire")
+	}
+	if got := vc.Now(); !got.Equal(t0.Add(time.Hour + time.Second)) {
+		t.Errorf("Now = %v", got)
+	}
+}
+
+// A wait given up on leaves nothing behind on the clock.
+func TestVirtualClockStop(t *testing.T) {
+	vc := NewVirtualClock(time.Unix(1000, 0))
+	ch := vc.After(time.Minute)
+	vc.Stop(ch)
+
+	srv := NewSenSrv("stop", 0)
+	srv.SetClock(vc)
+	s := testSensor(t, srv)
+	cancel := make(chan struct{})
+	close(cancel)
+	for i := 0; i < 10; i++ {
+		if r := s.wait(s.reading().Seq, cancel, time.Minute); r != nil {
+			t.Fatalf("cancelled wait returned %v", r)
+		}
+	}
+	if n := len(vc.waiters); n != 0 {
+		t.Errorf("%d waiters left after cancelled waits", n)
+	}
+	vc.Advance(time.Hour)
+	if _, ok := received(ch); ok {
+		t.Errorf("stopped waiter fired")
+	}
+}
+
+func TestWallClockAdvance(t *testing.T) {
+	c := new(WallClock)
+	start := c.Now()
+	ch := c.After(time.Hour)
+	c.Advance(time.Hour)
+	select {
+	case got := <-ch:
+		if got.Sub(start) < time.Hour {
+			t.Errorf("fired at %v, an hour on from %v", got, start)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("advancing past the wait did not end it")
+	}
+
+	// a partial advance shortens the wait
+	ch = c.After(time.Hour + 50*time.Millisecond)
+	c.Advance(time.Hour)
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shortened wait did not end")
+	}
+
+	ch = c.After(10 * time.Millisecond)
+	c.Stop(ch)
+	time.Sleep(50 * time.Millisecond)
+	if _, ok := received(ch); ok {
+		t.Errorf("stopped waiter fired")
+	}
+	if n := len(c.waiters); n != 0 {
+		t.Errorf("%d waiters left", n)
+	}
+}
+
+// counter is a model that counts its samples.
+type counter struct{ n int }
+
+func (c *counter) Sample(t time.Time) float64 {
+	c.n++
+	return float64(c.n)
+}
+
+// A read after a long idle takes a bounded number of samples but
+// still counts every interval.
+func TestCatchup(t *testing.T) {
+	vc := NewVirtualClock(time.Unix(1000, 0))
+	srv := NewSenSrv("catchup", 0)
+	srv.SetClock(vc)
+	s := testSensor(t, srv)
+	m := new(counter)
+	s.model = m
+	s.reading()
+
+	vc.Advance(365 * 24 * time.Hour)
+	r := s.reading()
+	if want := uint64(365*24*3600 + 1); r.Seq != want {
+		t.Errorf("seq %d, want %d", r.Seq, want)
+	}
+	if m.n > defaultHistory+2 {
+		t.Errorf("%d samples taken catching up", m.n)
+	}
+	if h := s.history(0, 2*defaultHistory); len(h) != defaultHistory || h[len(h)-1].Seq != r.Seq {
+		t.Errorf("history of %d readings after catching up", len(h))
+	}
+}
+
+// testSensor adds a sensor to srv and returns it.
+func testSensor(t *testing.T, srv *SenSrv) *sensorItem {
+	t.Helper()
+	if err := srv.AddSensor("temp"); err != nil {
+		t.Fatal(err)
+	}
+	return srv.lookup("temp").item.(*sensorItem)
+}
@@ -0,0 +1,286 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package sensim
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lavaorg/warp/warp9"
+)
+
+// CmdFunc implements a ctl command. args is the text following the
+// command name. The returned text is queued as the command's result
+// for the fid that wrote it.
+type CmdFunc func(srv *SenSrv, args string) (string, error)
+
+// ctlItem is the command object. Each written line is a command of
+// the form "name args" (or "name:args"); results are queued per fid
+// and read back one line per command.
+type ctlItem struct {
+	dev  *SenSrv
+	cmds map[string]CmdFunc
+}
+
+const ctlInfo = "sensim ctl: commands: status, set-interval <dur>, set-value <val>, reset, set-unit <unit> [path], set-format <enc> [path], set-history <n> [path], set-next-wait <dur> [path], advance <dur>, ip:<addr>, actuators, fw-install <sha256> <ver>, fw-reset, fw-fail <stage>, fw-reboot <dur>, fault <kind>|list|clear\n"
+
+func newCtlItem(srv *SenSrv) itemMaker {
+	return func(sdir *SenDir) (*SenDir, error) {
+		ctl := &ctlItem{dev: srv, cmds: make(map[string]CmdFunc)}
+		ctl.AddCommand("status", cmdStatus)
+		ctl.AddCommand("set-interval", cmdSetInterval)
+		ctl.AddCommand("set-value", cmdSetValue)
+		ctl.AddCommand("reset", cmdReset)
+		ctl.AddCommand("set-unit", cmdSetUnit)
+		ctl.AddCommand("set-format", cmdSetFormat)
+		ctl.AddCommand("set-history", cmdSetHistory)
+		ctl.AddCommand("set-next-wait", cmdSetNextWait)
+		ctl.AddCommand("advance", cmdAdvance)
+		ctl.AddCommand("ip", cmdReportAddr)
+		ctl.AddCommand("actuators", cmdActuators)
+		ctl.AddCommand("fw-install", cmdFwInstall)
+		ctl.AddCommand("fw-reset", cmdFwReset)
+		ctl.AddCommand("fw-fail", cmdFwFail)
+		ctl.AddCommand("fw-reboot", cmdFwReboot)
+		ctl.AddCommand("fault", cmdFault)
+
+		sdir.Mode = uint32(perms(warp9.DMREAD|warp9.DMWRITE, warp9.DMREAD|warp9.DMWRITE, warp9.DMREAD))
+		sdir.item = ctl
+		return sdir, nil
+	}
+}
+
+// AddCommand adds or replaces a command; a nil f removes it.
+func (ctl *ctlItem) AddCommand(name string, f CmdFunc) {
+	if f == nil {
+		delete(ctl.cmds, name)
+		return
+	}
+	ctl.cmds[name] = f
+}
+
+func (ctl *ctlItem) Stat(dir *SenDir) error { return nil }
+
+func (ctl *ctlItem) Open(dir *SenDir, mode uint8) (Handle, error) {
+	return &ctlHandle{ctl: ctl}, nil
+}
+
+// ctlHandle holds the results of the commands written on one fid.
+type ctlHandle struct {
+	sync.Mutex
+	ctl     *ctlItem
+	results []byte
+}
+
+// ReadAt without a preceding command returns the info message.
+func (h *ctlHandle) ReadAt(off uint64, count uint32) ([]byte, error) {
+	h.Lock()
+	defer h.Unlock()
+	if len(h.results) == 0 {
+		return window([]byte(ctlInfo), off, count), nil
+	}
+	return window(h.results, off, count), nil
+}
+
+func (h *ctlHandle) WriteAt(data []byte, off uint64) (uint32, error) {
+	h.Lock()
+	defer h.Unlock()
+	res, err := h.ctl.exec(h.ctl.dev, data, h.results)
+	h.results = res
+	if err != nil {
+		return 0, err
+	}
+	return uint32(len(data)), nil
+}
+
+func (h *ctlHandle) Clunk() {}
+
+// exec runs each command line in data and appends the results to out.
+// Execution stops at the first failing command, whose error is
+// appended as an "error: <msg>" line.
+func (ctl *ctlItem) exec(srv *SenSrv, data []byte, out []byte) ([]byte, error) {
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		name, args := splitCmd(line)
+		f := ctl.cmds[name]
+		if f == nil {
+			return failed(out, fmt.Errorf("unknown command: %s", name))
+		}
+		res, err := f(srv, args)
+		if err != nil {
+			return failed(out, fmt.Errorf("%s: %v", name, err))
+		}
+		out = append(out, strings.TrimRight(res, "\n")...)
+		out = append(out, '\n')
+	}
+	return out, nil
+}
+
+// failed appends err to the results as an error line.
+func failed(out []byte, err error) ([]byte, error) {
+	out = append(out, "error: "...)
+	out = append(out, err.Error()...)
+	return append(out, '\n'), err
+}
+
+// splitCmd separates the command name from its args at the first
+// space or colon.
+func splitCmd(line string) (string, string) {
+	i := strings.IndexAny(line, " :")
+	if i < 0 {
+		return line, ""
+	}
+	return line[:i], strings.TrimSpace(line[i+1:])
+}
+
+func (srv *SenSrv) sensor() *sensorItem {
+	return srv.lookup("sensors").item.(*sensorItem)
+}
+
+func cmdStatus(srv *SenSrv, args string) (string, error) {
+	srv.faults.Lock()
+	nf := len(srv.faults.list)
+	srv.faults.Unlock()
+	return fmt.Sprintf("serial:%s time:%s sensor:%v report:%s faults:%d %s", srv.Identity().Serial, srv.Clock().Now().Format(time.RFC3339), srv.sensor(), srv.ReportAddr(), nf, srv.stats.summary()), nil
+}
+
+func cmdSetInterval(srv *SenSrv, args string) (string, error) {
+	d, err := time.ParseDuration(args)
+	if err != nil {
+		return "", err
+	}
+	if d <= 0 {
+		return "", fmt.Errorf("interval must be positive")
+	}
+	srv.sensor().setInterval(d)
+	return "ok", nil
+}
+
+func cmdSetValue(srv *SenSrv, args string) (string, error) {
+	v, err := strconv.ParseFloat(args, 64)
+	if err != nil {
+		return "", err
+	}
+	srv.sensor().set(v)
+	return "ok", nil
+}
+
+func cmdReset(srv *SenSrv, args string) (string, error) {
+	if err := srv.sensor().reset(); err != nil {
+		return "", err
+	}
+	return "ok", nil
+}
+
+// sensorArg splits "arg [path]" and finds the sensor at path, by
+// default "sensors".
+func (srv *SenSrv) sensorArg(args string) (string, *sensorItem, error) {
+	f := strings.Fields(args)
+	switch len(f) {
+	case 1:
+		return f[0], srv.sensor(), nil
+	case 2:
+		if d := srv.lookup(f[1]); d != nil {
+			if s, ok := d.item.(*sensorItem); ok {
+				return f[0], s, nil
+			}
+		}
+		return "", nil, fmt.Errorf("no sensor: %s", f[1])
+	}
+	return "", nil, fmt.Errorf("usage: <arg> [path]")
+}
+
+func cmdSetUnit(srv *SenSrv, args string) (string, error) {
+	unit, s, err := srv.sensorArg(args)
+	if err != nil {
+		return "", err
+	}
+	s.setUnit(unit)
+	return "ok", nil
+}
+
+func cmdSetFormat(srv *SenSrv, args string) (string, error) {
+	enc, s, err := srv.sensorArg(args)
+	if err != nil {
+		return "", err
+	}
+	if err = s.setEncoding(enc); err != nil {
+		return "", err
+	}
+	return "ok", nil
+}
+
+func cmdSetHistory(srv *SenSrv, args string) (string, error) {
+	arg, s, err := srv.sensorArg(args)
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(arg)
+	if err != nil {
+		return "", err
+	}
+	if n < 0 {
+		return "", fmt.Errorf("history must not be negative")
+	}
+	s.setHistory(n)
+	return "ok", nil
+}
+
+func cmdSetNextWait(srv *SenSrv, args string) (string, error) {
+	arg, s, err := srv.sensorArg(args)
+	if err != nil {
+		return "", err
+	}
+	d, err := time.ParseDuration(arg)
+	if err != nil {
+		return "", err
+	}
+	if d <= 0 {
+		return "", fmt.Errorf("wait must be positive")
+	}
+	s.setNextWait(d)
+	return "ok", nil
+}
+
+// advance fast-forwards the device clock.
+func cmdAdvance(srv *SenSrv, args string) (string, error) {
+	d, err := time.ParseDuration(args)
+	if err != nil {
+		return "", err
+	}
+	if d < 0 {
+		return "", fmt.Errorf("cannot go back in time")
+	}
+	srv.Clock().Advance(d)
+	return "ok", nil
+}
+
+// ip:<addr> sets the address the device reports (dials) to.
+func cmdReportAddr(srv *SenSrv, args string) (string, error) {
+	if args == "" {
+		return "", fmt.Errorf("missing address")
+	}
+	srv.SetReportAddr(args)
+	return "ok", nil
+}
+
+// Command runs a ctl command line as if it was written to the ctl
+// object and returns its result.
+func (srv *SenSrv) Command(line string) (string, error) {
+	ctl, ok := srv.lookup("ctl").item.(*ctlItem)
+	if !ok {
+		return "", fmt.Errorf("no ctl object")
+	}
+	res, err := ctl.exec(srv, []byte(line), nil)
+	if err != nil {
+		return "", err
+	}
+	return string(res), nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package sensim
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lavaorg/warp/warp9"
+)
+
+// value is the sensor's current value.
+func value(s *sensorItem) float64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.value
+}
+
+func TestCtl(t *testing.T) {
+	srv := NewSenSrv("ctl", 0)
+	ctl := srv.lookup("ctl").item.(*ctlItem)
+	h, _ := ctl.Open(srv.lookup("ctl"), warp9.ORDWR)
+	if b, _ := h.ReadAt(0, 8192); string(b) != ctlInfo {
+		t.Errorf("read before any command: %q", b)
+	}
+
+	results := ""
+	for _, tc := range []struct {
+		cmd  string
+		ok   bool
+		want string // start of the line the command adds to the results
+	}{
+		{"set-value 42", true, "ok"},
+		{"set-interval:2s", true, "ok"},
+		{"status", true, "serial:"},
+		{"bogus", false, "error: unknown command: bogus"},
+		{"set-interval soon", false, "error: set-interval: time: invalid duration"},
+		{"set-interval -1s", false, "error: set-interval: interval must be positive"},
+		{"set-history 5 dev/missing", false, "error: set-history: no sensor: dev/missing"},
+		{"set-unit", false, "error: set-unit: usage: <arg> [path]"},
+	} {
+		n, err := h.WriteAt([]byte(tc.cmd+"\n"), 0)
+		if ok := err == nil; ok != tc.ok {
+			t.Errorf("%q: error %v", tc.cmd, err)
+		}
+		if tc.ok && n != uint32(len(tc.cmd)+1) {
+			t.Errorf("%q: wrote %d bytes", tc.cmd, n)
+		}
+		b, _ := h.ReadAt(0, 8192)
+		if !strings.HasPrefix(string(b), results) {
+			t.Fatalf("%q: results %q no longer start with %q", tc.cmd, b, results)
+		}
+		if line := string(b[len(results):]); !strings.HasPrefix(line, tc.want) || strings.Count(line, "\n") != 1 {
+			t.Errorf("%q: added %q, want a line starting %q", tc.cmd, line, tc.want)
+		}
+		results = string(b)
+	}
+	if v := value(srv.sensor()); v != 42 {
+		t.Errorf("sensor %v after set-value 42", v)
+	}
+
+	// results are per fid; a failure stops the rest of the write
+	h, _ = ctl.Open(srv.lookup("ctl"), warp9.ORDWR)
+	if _, err := h.WriteAt([]byte("set-value 1\nnope\nset-value 2\n"), 0); err == nil {
+		t.Errorf("write with an unknown command succeeded")
+	}
+	if b, _ := h.ReadAt(0, 8192); string(b) != "ok\nerror: unknown command: nope\n" {
+		t.Errorf("results %q", b)
+	}
+	if v := value(srv.sensor()); v != 1 {
+		t.Errorf("sensor %v after a failed write", v)
+	}
+}
@@ -0,0 +1,378 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package sensim
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lavaorg/warp/warp9"
+)
+
+// Fault makes the device misbehave on matching requests:
+//
+//	delay   -- answer after Delay
+//	error   -- answer with warp9 error Error
+//	corrupt -- flip bits in the data returned by a read
+//	drop    -- close the connection without answering
+//	hang    -- answer only when flushed, with an error
+//
+// Path limits the fault to an object or subtree ("" is everything),
+// Op to one request type (attach, walk, open, read, write, stat).
+// Prob is the chance the fault fires (0 is always) and Count the
+// number of times it fires (0 is unlimited).
+type Fault struct {
+	Kind  string   `json:"kind"`
+	Path  string   `json:"path"`
+	Op    string   `json:"op"`
+	Delay Duration `json:"delay"`
+	Error string   `json:"error"` // name (e.g. eio) or number
+	Prob  float64  `json:"prob"`
+	Count int      `json:"count"`
+
+	code  int16
+	fired int
+}
+
+// faultErrors are the warp9 error names accepted by Fault.Error.
+var faultErrors = map[string]int16{
+	"eperm":     warp9.Eperm,
+	"enotexist": warp9.Enotexist,
+	"einuse":    warp9.Einuse,
+	"ebaduse":   warp9.Ebaduse,
+	"etoolarge": warp9.Etoolarge,
+	"enotimpl":  warp9.Enotimpl,
+	"eio":       warp9.Eio,
+	"einval":    warp9.Einval,
+	"econn":     warp9.Econn,
+	"eeof":      warp9.Eeof,
+}
+
+var faultOps = map[string]bool{
+	"": true, "attach": true, "walk": true, "open": true, "read": true, "write": true, "stat": true,
+}
+
+func (f *Fault) check() error {
+	switch f.Kind {
+	case "delay", "corrupt", "drop", "hang":
+	case "error":
+		if f.Error == "" {
+			f.Error = "eio"
+		}
+		if code, ok := faultErrors[strings.ToLower(f.Error)]; ok {
+			f.code = code
+		} else if n, err := strconv.ParseInt(f.Error, 10, 16); err == nil && n < 0 {
+			f.code = int16(n)
+		} else {
+			return fmt.Errorf("unknown error: %s", f.Error)
+		}
+	default:
+		return fmt.Errorf("unknown fault: %q", f.Kind)
+	}
+	if !faultOps[f.Op] {
+		return fmt.Errorf("unknown op: %s", f.Op)
+	}
+	if f.Prob < 0 || f.Prob > 1 {
+		return fmt.Errorf("prob must be within 0..1")
+	}
+	f.Path = strings.Join(splitPath(f.Path), "/")
+	return nil
+}
+
+func (f *Fault) String() string {
+	s := f.Kind
+	if f.Path != "" {
+		s += " path=" + f.Path
+	}
+	if f.Op != "" {
+		s += " op=" + f.Op
+	}
+	if f.Delay != 0 {
+		s += " delay=" + time.Duration(f.Delay).String()
+	}
+	if f.Kind == "error" {
+		s += " error=" + f.Error
+	}
+	if f.Prob != 0 {
+		s += fmt.Sprintf(" prob=%g", f.Prob)
+	}
+	if f.Count != 0 {
+		s += fmt.Sprintf(" count=%d", f.Count)
+	}
+	return s + fmt.Sprintf(" fired=%d", f.fired)
+}
+
+// parseFault reads "kind key=val ..." as written to ctl.
+func parseFault(args string) (*Fault, error) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("missing fault kind")
+	}
+	f := &Fault{Kind: fields[0]}
+	for _, kv := range fields[1:] {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("bad argument: %s", kv)
+		}
+		k, v := kv[:i], kv[i+1:]
+		var err error
+		switch k {
+		case "path":
+			f.Path = v
+		case "op":
+			f.Op = v
+		case "delay":
+			var d time.Duration
+			d, err = time.ParseDuration(v)
+			f.Delay = Duration(d)
+		case "error":
+			f.Error = v
+		case "prob":
+			f.Prob, err = strconv.ParseFloat(v, 64)
+		case "count":
+			f.Count, err = strconv.Atoi(v)
+		default:
+			return nil, fmt.Errorf("unknown argument: %s", k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", k, err)
+		}
+	}
+	return f, f.check()
+}
+
+// faults is a device's set of active faults.
+type faults struct {
+	sync.Mutex
+	list  []*Fault
+	rng   *rand.Rand
+	conns map[string]net.Conn // connections served by Serve, for drop
+}
+
+// AddFault activates f on the device.
+func (srv *SenSrv) AddFault(f *Fault) error {
+	if err := f.check(); err != nil {
+		return err
+	}
+	srv.faults.Lock()
+	srv.faults.list = append(srv.faults.list, f)
+	srv.faults.Unlock()
+	return nil
+}
+
+// ClearFaults removes every fault.
+func (srv *SenSrv) ClearFaults() {
+	srv.faults.Lock()
+	srv.faults.list = nil
+	srv.faults.Unlock()
+}
+
+// SeedFaults seeds the random source used by probabilistic faults
+// and payload corruption.
+func (srv *SenSrv) SeedFaults(seed int64) {
+	srv.faults.Lock()
+	srv.faults.rng = rand.New(rand.NewSource(seed))
+	srv.faults.Unlock()
+}
+
+// fault returns the first fault that fires for op on entry sdir.
+// Exhausted faults are removed.
+func (srv *SenSrv) fault(op string, sdir *SenDir) *Fault {
+	srv.faults.Lock()
+	n := len(srv.faults.list)
+	srv.faults.Unlock()
+	if n == 0 {
+		return nil
+	}
+	path := srv.pathOf(sdir)
+
+	srv.faults.Lock()
+	defer srv.faults.Unlock()
+	fs := &srv.faults
+	if fs.rng == nil {
+		fs.rng = rand.New(rand.NewSource(1))
+	}
+	for i, f := range fs.list {
+		if f.Op != "" && f.Op != op {
+			continue
+		}
+		if f.Path != "" && path != f.Path && !strings.HasPrefix(path, f.Path+"/") {
+			continue
+		}
+		if f.Prob != 0 && fs.rng.Float64() >= f.Prob {
+			continue
+		}
+		f.fired++
+		if f.Count != 0 && f.fired >= f.Count {
+			fs.list = append(fs.list[:i:i], fs.list[i+1:]...)
+		}
+		return f
+	}
+	return nil
+}
+
+// inject applies f to req. It reports whether req has been dealt
+// with; if not the request is served normally (after any delay).
+func (srv *SenSrv) inject(req *warp9.SrvReq, f *Fault) bool {
+	if f == nil {
+		return false
+	}
+	if srv.Debuglevel > 0 {
+		log.Printf("fault: %s\n", f.Kind)
+	}
+	switch f.Kind {
+	case "delay":
+		time.Sleep(time.Duration(f.Delay))
+	case "error":
+		req.RespondError(warp9.Error(f.code))
+		return true
+	case "drop":
+		srv.faults.Lock()
+		c := srv.faults.conns[connKey(req.Conn.LocalAddr(), req.Conn.RemoteAddr())]
+		srv.faults.Unlock()
+		if c != nil {
+			c.Close()
+		} else {
+			log.Printf("fault: drop: connection not served by Serve; hanging\n")
+			srv.hang(req)
+		}
+		return true
+	case "hang":
+		srv.hang(req)
+		return true
+	}
+	return false
+}
+
+// hang leaves req unanswered until it is flushed, when it fails, or
+// its connection closes.
+func (srv *SenSrv) hang(req *warp9.SrvReq) {
+	if !srv.block(req, nil) {
+		req.RespondError(warp9.Error(warp9.Eio))
+	}
+}
+
+// corrupt flips a bit in roughly one of every 16 bytes of data.
+func (srv *SenSrv) corrupt(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	srv.faults.Lock()
+	defer srv.faults.Unlock()
+	if srv.faults.rng == nil {
+		srv.faults.rng = rand.New(rand.NewSource(1))
+	}
+	rng := srv.faults.rng
+	for n := len(data)/16 + 1; n > 0; n-- {
+		data[rng.Intn(len(data))] ^= 1 << uint(rng.Intn(8))
+	}
+}
+
+func connKey(local, remote net.Addr) string {
+	return local.String() + "|" + remote.String()
+}
+
+// dropConns closes every connection served by Serve.
+func (srv *SenSrv) dropConns() {
+	srv.faults.Lock()
+	for _, c := range srv.faults.conns {
+		c.Close()
+	}
+	srv.faults.Unlock()
+}
+
+// Serve serves the device on c until the connection closes.
+// Connections served this way can be dropped by faults and reboots;
+// the warp9.Srv methods that serve connections are routed here. While
+// the device is down c is closed at once.
+func (srv *SenSrv) Serve(c net.Conn) {
+	if !srv.isUp() {
+		c.Close()
+		return
+	}
+	key := connKey(c.LocalAddr(), c.RemoteAddr())
+	srv.faults.Lock()
+	if srv.faults.conns == nil {
+		srv.faults.conns = make(map[string]net.Conn)
+	}
+	srv.faults.conns[key] = c
+	srv.faults.Unlock()
+
+	srv.Srv.NewConnWait(c)
+
+	srv.faults.Lock()
+	delete(srv.faults.conns, key)
+	srv.faults.Unlock()
+}
+
+// ServeListener accepts connections on l and serves each with Serve.
+func (srv *SenSrv) ServeListener(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go srv.Serve(c)
+	}
+}
+
+func (srv *SenSrv) NewConn(c net.Conn)                 { go srv.Serve(c) }
+func (srv *SenSrv) NewConnWait(c net.Conn)             { srv.Serve(c) }
+func (srv *SenSrv) StartListener(l net.Listener) error { return srv.ServeListener(l) }
+
+func (srv *SenSrv) StartNetListener(ntype, addr string) error {
+	l, err := net.Listen(ntype, addr)
+	if err != nil {
+		return err
+	}
+	return srv.ServeListener(l)
+}
+
+func (srv *SenSrv) InitiateConn(ntype, addr string, wait bool) error {
+	c, err := net.Dial(ntype, addr)
+	if err != nil {
+		return err
+	}
+	if wait {
+		srv.Serve(c)
+	} else {
+		go srv.Serve(c)
+	}
+	return nil
+}
+
+// fault kind [path=p] [op=o] [delay=d] [error=e] [prob=p] [count=n]
+// adds a fault; "fault list" shows them and "fault clear" removes all.
+func cmdFault(srv *SenSrv, args string) (string, error) {
+	switch strings.TrimSpace(args) {
+	case "list":
+		srv.faults.Lock()
+		defer srv.faults.Unlock()
+		var s []string
+		for _, f := range srv.faults.list {
+			s = append(s, f.String())
+		}
+		if len(s) == 0 {
+			return "no faults", nil
+		}
+		return strings.Join(s, "; "), nil
+	case "clear":
+		srv.ClearFaults()
+		return "ok", nil
+	}
+	f, err := parseFault(args)
+	if err != nil {
+		return "", err
+	}
+	if err = srv.AddFault(f); err != nil {
+		return "", err
+	}
+	return "ok", nil
+}
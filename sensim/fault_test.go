@@ -0,0 +1,60 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package sensim
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lavaorg/warp/warp9"
+)
+
+// A hung request fails when flushed, so the Tflush is answered, and
+// leaves nothing behind in the stats.
+func TestHangFlush(t *testing.T) {
+	srv := NewSenSrv("hang", 0)
+	c := dial(t, start(t, srv))
+	if err := srv.AddFault(&Fault{Kind: "hang", Op: "stat"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c.send(warp9.Tstat, 2, u32(0))
+	time.Sleep(50 * time.Millisecond) // let the stat hang
+	c.send(warp9.Tflush, 3, u16(2))
+	c.expect(warp9.Rerror, 2)
+	c.expect(warp9.Rflush, 3)
+
+	// a request hung when its connection closes is forgotten
+	c.send(warp9.Tstat, 4, u32(0))
+	time.Sleep(50 * time.Millisecond)
+	c.Close()
+	for i := 0; ; i++ {
+		srv.stats.Lock()
+		n := len(srv.stats.started) + len(srv.stats.conns)
+		srv.stats.Unlock()
+		srv.blockmu.Lock()
+		n += len(srv.blocked)
+		srv.blockmu.Unlock()
+		if n == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("%d requests or connections left after close", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Connections accepted by the warp9.Srv listener can be dropped too.
+func TestDrop(t *testing.T) {
+	srv := NewSenSrv("drop", 0)
+	c := dial(t, start(t, srv))
+	if err := srv.AddFault(&Fault{Kind: "drop", Op: "stat"}); err != nil {
+		t.Fatal(err)
+	}
+	c.send(warp9.Tstat, 2, u32(0))
+	if fc := c.recv(); fc != nil {
+		t.Errorf("dropped stat answered with type %d", fc.Type)
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package sensim
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lavaorg/warp/warp9"
+)
+
+const (
+	maxImage      = 16 << 20 // largest firmware image accepted
+	defaultReboot = 5 * time.Second
+)
+
+// Firmware update stages that can be told to fail (ctl fw-fail):
+//
+//	upload -- writes to the firmware object fail
+//	verify -- the checksum never matches
+//	apply  -- the device reboots but comes back with the old version
+//	boot   -- the device never comes back
+var fwStages = map[string]bool{"none": true, "upload": true, "verify": true, "apply": true, "boot": true}
+
+// firmwareItem accepts a firmware image, written in chunks at any
+// offset and in any order; ctl "fw-reset" discards what was written
+// to start a new image. ctl "fw-install <sha256> <version>" checks the image and
+// reboots the device into the new version: every connection is
+// dropped and the device stays down for the reboot delay. Reading the
+// object shows the update state.
+type firmwareItem struct {
+	sync.Mutex
+	srv    *SenSrv
+	image  []byte
+	state  string // idle, uploading, rebooting or failed: <why>
+	fail   string // stage to fail at
+	reboot time.Duration
+}
+
+func newFirmwareItem(srv *SenSrv) itemMaker {
+	return func(sdir *SenDir) (*SenDir, error) {
+		sdir.Mode = uint32(perms(warp9.DMREAD|warp9.DMWRITE, warp9.DMREAD|warp9.DMWRITE, warp9.DMREAD))
+		sdir.item = &firmwareItem{srv: srv, state: "idle", fail: "none", reboot: defaultReboot}
+		return sdir, nil
+	}
+}
+
+func (fw *firmwareItem) Stat(dir *SenDir) error {
+	fw.Lock()
+	dir.Length = uint64(len(fw.image))
+	fw.Unlock()
+	return nil
+}
+
+// Live: reads show the update state as it changes.
+func (fw *firmwareItem) Live() bool { return true }
+
+func (fw *firmwareItem) Open(dir *SenDir, mode uint8) (Handle, error) {
+	return openItem(fw, func(data []byte, off uint64) error { return fw.write(off, data) })
+}
+
+func (fw *firmwareItem) Read() ([]byte, error) {
+	fw.Lock()
+	defer fw.Unlock()
+	return []byte(fmt.Sprintf("state:%s size:%d version:%s fail:%s\n",
+		fw.state, len(fw.image), fw.srv.Identity().Firmware, fw.fail)), nil
+}
+
+// write stores a chunk of the image.
+func (fw *firmwareItem) write(off uint64, data []byte) error {
+	fw.Lock()
+	defer fw.Unlock()
+
+	if fw.state == "rebooting" {
+		return fmt.Errorf("firmware: rebooting")
+	}
+	if fw.fail == "upload" {
+		fw.state = "failed: upload"
+		return fmt.Errorf("firmware: upload failed")
+	}
+	end := off + uint64(len(data))
+	if end > maxImage {
+		return fmt.Errorf("firmware: image too large")
+	}
+	if end > uint64(len(fw.image)) {
+		fw.image = append(fw.image, make([]byte, int(end)-len(fw.image))...)
+	}
+	copy(fw.image[off:], data)
+	fw.state = "uploading"
+	return nil
+}
+
+// reset discards the image written so far.
+func (fw *firmwareItem) reset() error {
+	fw.Lock()
+	defer fw.Unlock()
+
+	if fw.state == "rebooting" {
+		return fmt.Errorf("rebooting")
+	}
+	fw.image = nil
+	fw.state = "idle"
+	return nil
+}
+
+// install checks the image against sum and reboots the device into
+// version.
+func (fw *firmwareItem) install(sum, version string) error {
+	fw.Lock()
+	defer fw.Unlock()
+
+	if fw.state == "rebooting" {
+		return fmt.Errorf("rebooting")
+	}
+	if len(fw.image) == 0 {
+		return fmt.Errorf("no image")
+	}
+	h := sha256.Sum256(fw.image)
+	if fw.fail == "verify" || !strings.EqualFold(sum, hex.EncodeToString(h[:])) {
+		fw.state = "failed: verify"
+		return fmt.Errorf("checksum mismatch")
+	}
+	if fw.fail == "apply" {
+		version = fw.srv.Identity().Firmware
+	}
+	fw.state = "rebooting"
+	fail, delay := fw.fail, fw.reboot
+
+	// let the ctl reply get out before the connections go
+	time.AfterFunc(100*time.Millisecond, func() {
+		fw.srv.reboot(delay, fail == "boot", func() {
+			fw.Lock()
+			fw.image = nil
+			fw.state = "idle"
+			if fail == "apply" {
+				fw.state = "failed: apply"
+			}
+			fw.Unlock()
+			fw.srv.SetIdentity(&Identity{Firmware: version})
+		})
+	})
+	return nil
+}
+
+// reboot takes the device down for delay on the device clock:
+// connections are dropped and refused until it is up again. booted
+// runs as it comes up. A device that hangs at boot never comes up.
+func (srv *SenSrv) reboot(delay time.Duration, hang bool, booted func()) {
+	srv.mu.Lock()
+	up := make(chan struct{})
+	srv.up = up
+	clock := srv.clock
+	srv.mu.Unlock()
+
+	if srv.Debuglevel > 0 {
+		log.Printf("%s: rebooting\n", srv.Id)
+	}
+	srv.dropConns()
+	if hang {
+		return
+	}
+
+	done := clock.After(delay)
+	go func() {
+		<-done
+		booted()
+		srv.mu.Lock()
+		srv.ident.Boots++
+		srv.boot = srv.clock.Now()
+		srv.mu.Unlock()
+		close(up)
+	}()
+}
+
+// Up returns a channel that is closed while the device is up.
+func (srv *SenSrv) Up() <-chan struct{} {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.up
+}
+
+func (srv *SenSrv) isUp() bool {
+	select {
+	case <-srv.Up():
+		return true
+	default:
+		return false
+	}
+}
+
+func (srv *SenSrv) firmware() (*firmwareItem, error) {
+	if d := srv.lookup("firmware"); d != nil {
+		if fw, ok := d.item.(*firmwareItem); ok {
+			return fw, nil
+		}
+	}
+	return nil, fmt.Errorf("no firmware object")
+}
+
+// fw-install <sha256> <version>
+func cmdFwInstall(srv *SenSrv, args string) (string, error) {
+	f := strings.Fields(args)
+	if len(f) != 2 {
+		return "", fmt.Errorf("usage: fw-install <sha256> <version>")
+	}
+	fw, err := srv.firmware()
+	if err != nil {
+		return "", err
+	}
+	if err = fw.install(f[0], f[1]); err != nil {
+		return "", err
+	}
+	return "ok rebooting", nil
+}
+
+// fw-reset discards the image written to the firmware object.
+func cmdFwReset(srv *SenSrv, args string) (string, error) {
+	fw, err := srv.firmware()
+	if err != nil {
+		return "", err
+	}
+	if err = fw.reset(); err != nil {
+		return "", err
+	}
+	return "ok", nil
+}
+
+// fw-fail <stage> makes the next update fail at stage (none to stop).
+func cmdFwFail(srv *SenSrv, args string) (string, error) {
+	if !fwStages[args] {
+		return "", fmt.Errorf("unknown stage: %s", args)
+	}
+	fw, err := srv.firmware()
+	if err != nil {
+		return "", err
+	}
+	fw.Lock()
+	fw.fail = args
+	fw.Unlock()
+	return "ok", nil
+}
+
+// fw-reboot <dur> sets how long the device is down after an update.
+func cmdFwReboot(srv *SenSrv, args string) (string, error) {
+	d, err := time.ParseDuration(args)
+	if err != nil {
+		return "", err
+	}
+	if d < 0 {
+		return "", fmt.Errorf("reboot delay must not be negative")
+	}
+	fw, err := srv.firmware()
+	if err != nil {
+		return "", err
+	}
+	fw.Lock()
+	fw.reboot = d
+	fw.Unlock()
+	return "ok", nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package sensim
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+// A reboot drops every connection and lasts its delay on the device
+// clock.
+func TestFirmwareReboot(t *testing.T) {
+	vc := NewVirtualClock(time.Unix(1000, 0))
+	srv := NewSenSrv("fw", 0)
+	srv.SetClock(vc)
+	c := dial(t, start(t, srv))
+
+	fw, err := srv.firmware()
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := []byte("firmware image")
+	if err := fw.write(0, img); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.Command("fw-reboot 1m"); err != nil {
+		t.Fatal(err)
+	}
+	boots := srv.Identity().Boots
+	h := sha256.Sum256(img)
+	if _, err := srv.Command("fw-install " + hex.EncodeToString(h[:]) + " 2.0.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if fc := c.recv(); fc != nil {
+		t.Fatalf("connection kept through the reboot; got type %d", fc.Type)
+	}
+	if srv.isUp() {
+		t.Fatal("up during the reboot")
+	}
+	vc.Advance(59 * time.Second)
+	time.Sleep(50 * time.Millisecond)
+	if srv.isUp() {
+		t.Fatal("up before the reboot delay passed on the device clock")
+	}
+	vc.Advance(time.Second)
+	select {
+	case <-srv.Up():
+	case <-time.After(5 * time.Second):
+		t.Fatal("still down after the reboot delay")
+	}
+	if id := srv.Identity(); id.Firmware != "2.0.0" || id.Boots != boots+1 {
+		t.Errorf("came up as %+v", id)
+	}
+}
+
+// Chunks may arrive in any order; only fw-reset starts over.
+func TestFirmwareUpload(t *testing.T) {
+	srv := NewSenSrv("fw", 0)
+	fw, err := srv.firmware()
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := []byte("firmware image")
+	h := sha256.Sum256(img)
+	sum := hex.EncodeToString(h[:])
+
+	if err := fw.write(0, []byte("junk left from an earlier upload")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.Command("fw-reset"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.install(sum, "2.0.0"); err == nil {
+		t.Fatal("installed after a reset")
+	}
+	for _, c := range []struct{ off, end int }{{8, len(img)}, {4, 8}, {0, 4}} {
+		if err := fw.write(uint64(c.off), img[c.off:c.end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fw.install(sum, "2.0.0"); err != nil {
+		t.Errorf("image written out of order: %v", err)
+	}
+}
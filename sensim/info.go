@@ -0,0 +1,140 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package sensim
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// Identity is what a device reports about itself in its info
+// directory:
+//
+//	info/serial    -- serial number
+//	info/model     -- model name
+//	info/firmware  -- firmware version
+//	info/id        -- MAC-like hardware id
+//	info/boots     -- boot count
+//	info/uptime    -- seconds since boot on the device clock
+//
+// Collectors can use these to register a device by what it is rather
+// than where it connects from.
+type Identity struct {
+	Serial   string `json:"serial"`
+	Model    string `json:"model"`
+	Firmware string `json:"firmware"`
+	ID       string `json:"id"`
+	Boots    int    `json:"boots"`
+}
+
+const (
+	defaultDevModel = "sensim-t1"
+	defaultFirmware = "1.0.0"
+)
+
+// NewIdentity generates an identity from seed; the same seed always
+// gives the same identity.
+func NewIdentity(seed int64) *Identity {
+	rng := rand.New(rand.NewSource(seed))
+	mac := make([]byte, 6)
+	rng.Read(mac)
+	mac[0] = mac[0]&0xfc | 0x02 // locally administered, unicast
+	return &Identity{
+		Serial:   fmt.Sprintf("SIM%08d", rng.Intn(100000000)),
+		Model:    defaultDevModel,
+		Firmware: defaultFirmware,
+		ID:       fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", mac[0], mac[1], mac[2], mac[3], mac[4], mac[5]),
+		Boots:    1 + rng.Intn(20),
+	}
+}
+
+// merge fills the unset fields of id from def.
+func (id *Identity) merge(def *Identity) {
+	if id.Serial == "" {
+		id.Serial = def.Serial
+	}
+	if id.Model == "" {
+		id.Model = def.Model
+	}
+	if id.Firmware == "" {
+		id.Firmware = def.Firmware
+	}
+	if id.ID == "" {
+		id.ID = def.ID
+	}
+	if id.Boots == 0 {
+		id.Boots = def.Boots
+	}
+}
+
+// idSeed derives the default identity seed from a device id.
+func idSeed(id string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return int64(h.Sum64())
+}
+
+// infoItem serves one field of the device identity.
+type infoItem struct {
+	srv   *SenSrv
+	field func(id *Identity, uptime time.Duration) string
+}
+
+func (it *infoItem) Stat(dir *SenDir) error { return nil }
+
+func (it *infoItem) Read() ([]byte, error) {
+	id := it.srv.Identity()
+	return []byte(it.field(id, it.srv.Uptime())), nil
+}
+
+var infoFields = []struct {
+	name  string
+	field func(id *Identity, uptime time.Duration) string
+}{
+	{"serial", func(id *Identity, _ time.Duration) string { return id.Serial }},
+	{"model", func(id *Identity, _ time.Duration) string { return id.Model }},
+	{"firmware", func(id *Identity, _ time.Duration) string { return id.Firmware }},
+	{"id", func(id *Identity, _ time.Duration) string { return id.ID }},
+	{"boots", func(id *Identity, _ time.Duration) string { return strconv.Itoa(id.Boots) }},
+	{"uptime", func(_ *Identity, up time.Duration) string { return strconv.FormatInt(int64(up/time.Second), 10) }},
+}
+
+// addInfo creates the info directory.
+func (srv *SenSrv) addInfo() {
+	for _, f := range infoFields {
+		f := f
+		srv.addItem("info/"+f.name, func(sdir *SenDir) (*SenDir, error) {
+			sdir.item = &infoItem{srv, f.field}
+			return sdir, nil
+		})
+	}
+}
+
+// Identity returns a copy of the device identity.
+func (srv *SenSrv) Identity() *Identity {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	id := srv.ident
+	return &id
+}
+
+// SetIdentity replaces the device identity; unset fields keep their
+// current values.
+func (srv *SenSrv) SetIdentity(id *Identity) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	nid := *id
+	nid.merge(&srv.ident)
+	srv.ident = nid
+}
+
+// Uptime is the time since the device booted, on the device clock.
+func (srv *SenSrv) Uptime() time.Duration {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.clock.Now().Sub(srv.boot)
+}
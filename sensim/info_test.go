@@ -0,0 +1,77 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package sensim
+
+import (
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// info reads the info file name of srv.
+func info(t *testing.T, srv *SenSrv, name string) string {
+	t.Helper()
+	d := srv.lookup("info/" + name)
+	if d == nil {
+		t.Fatalf("no info/%s", name)
+	}
+	b, err := d.item.(*infoItem).Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// The info files show the identity, which follows the device id.
+func TestInfo(t *testing.T) {
+	vc := NewVirtualClock(time.Unix(1000, 0))
+	srv := NewSenSrv("info", 0)
+	srv.SetClock(vc)
+	id := srv.Identity()
+
+	if again := NewSenSrv("info", 0).Identity(); *again != *id {
+		t.Errorf("same device id gave %+v, then %+v", id, again)
+	}
+	if other := NewSenSrv("other", 0).Identity(); other.Serial == id.Serial || other.ID == id.ID {
+		t.Errorf("devices info and other share an identity: %+v", other)
+	}
+
+	for _, f := range []struct {
+		name string
+		form *regexp.Regexp // if set, the value must match
+		want string
+	}{
+		{"serial", regexp.MustCompile(`^SIM[0-9]{8}$`), id.Serial},
+		{"model", nil, defaultDevModel},
+		{"firmware", nil, defaultFirmware},
+		{"id", regexp.MustCompile(`^[0-9a-f]{2}(:[0-9a-f]{2}){5}$`), id.ID},
+		{"boots", regexp.MustCompile(`^[1-9][0-9]*$`), strconv.Itoa(id.Boots)},
+		{"uptime", nil, "0"},
+	} {
+		got := info(t, srv, f.name)
+		if got != f.want || f.form != nil && !f.form.MatchString(got) {
+			t.Errorf("info/%s = %q, want %q", f.name, got, f.want)
+		}
+	}
+	// a locally administered, unicast address
+	if b, _ := strconv.ParseUint(id.ID[:2], 16, 8); b&3 != 2 {
+		t.Errorf("id %s is not locally administered unicast", id.ID)
+	}
+
+	vc.Advance(90 * time.Second)
+	if got := info(t, srv, "uptime"); got != "90" {
+		t.Errorf("uptime %s after 90s", got)
+	}
+	srv.SetIdentity(&Identity{Firmware: "2.0.0", Boots: id.Boots + 1})
+	if got := info(t, srv, "firmware"); got != "2.0.0" {
+		t.Errorf("firmware %s after an update", got)
+	}
+	if got := info(t, srv, "boots"); got != strconv.Itoa(id.Boots+1) {
+		t.Errorf("boots %s, want %d", got, id.Boots+1)
+	}
+	if got := info(t, srv, "serial"); got != id.Serial {
+		t.Errorf("serial %s changed by an update", got)
+	}
+}
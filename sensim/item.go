@@ -0,0 +1,172 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package sensim
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/lavaorg/warp/warp9"
+)
+
+// Object is the full interface of an entry's content. Each open of
+// the entry calls Open, which returns the Handle serving that fid
+// until it is clunked. Stat fills in the entry's size and times.
+// SenSrv deals with every entry through this interface; simple Items
+// are adapted to it.
+type Object interface {
+	Stat(dir *SenDir) error
+	Open(dir *SenDir, mode uint8) (Handle, error)
+}
+
+// Handle is one open of an Object. An object may give offsets a
+// meaning of its own (e.g. sequence numbers). ReadAt returns at most
+// count bytes. Errors that are not *warp9.WarpError become Eio for
+// reads and Einval for writes; ErrReadOnly becomes Eperm.
+type Handle interface {
+	ReadAt(off uint64, count uint32) ([]byte, error)
+	WriteAt(data []byte, off uint64) (uint32, error)
+	Clunk()
+}
+
+// WaitHandle is a Handle whose reads may block. cancel is closed if
+// the read is flushed or the connection goes away.
+type WaitHandle interface {
+	Handle
+	ReadWait(off uint64, count uint32, cancel <-chan struct{}) ([]byte, error)
+}
+
+// ErrReadOnly is returned by handles that do not accept writes.
+var ErrReadOnly = errors.New("read only")
+
+// content is what an entry holds: an Item or an Object.
+type content interface {
+	Stat(dir *SenDir) error
+}
+
+// object returns the Object serving d, or nil for directories.
+func (d *SenDir) object() Object {
+	switch it := d.item.(type) {
+	case Object:
+		return it
+	case Item:
+		return itemObject{it}
+	}
+	return nil
+}
+
+// stat returns d's Dir as its object reports it. Entries are shared
+// by every fid, so the object fills in a copy.
+func (d *SenDir) stat() (*warp9.Dir, error) {
+	st := *d
+	if obj := d.object(); obj != nil {
+		if err := obj.Stat(&st); err != nil {
+			return nil, err
+		}
+	}
+	return &st.Dir, nil
+}
+
+// itemObject adapts a read-only Item.
+type itemObject struct {
+	Item
+}
+
+func (o itemObject) Stat(dir *SenDir) error {
+	if err := o.Item.Stat(dir); err != nil {
+		return err
+	}
+	if !live(o.Item) {
+		b, err := o.Read()
+		if err != nil {
+			return err
+		}
+		dir.Length = uint64(len(b))
+	}
+	return nil
+}
+
+func (o itemObject) Open(dir *SenDir, mode uint8) (Handle, error) {
+	return openItem(o.Item, nil)
+}
+
+// itemHandle serves an Item with the snapshot semantics described at
+// Item. write, if set, serves writes.
+type itemHandle struct {
+	sync.Mutex
+	item  Item
+	snap  []byte
+	fresh bool // snap was taken at open and not yet read
+	write func(data []byte, off uint64) error
+}
+
+func openItem(it Item, write func(data []byte, off uint64) error) (*itemHandle, error) {
+	h := &itemHandle{item: it, write: write}
+	if !live(it) {
+		b, err := it.Read()
+		if err != nil {
+			return nil, err
+		}
+		h.snap, h.fresh = b, true
+	}
+	return h, nil
+}
+
+func (h *itemHandle) ReadAt(off uint64, count uint32) ([]byte, error) {
+	if live(h.item) {
+		b, err := h.item.Read()
+		return window(b, off, count), err
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	if off == 0 && !h.fresh {
+		b, err := h.item.Read()
+		if err != nil {
+			return nil, err
+		}
+		h.snap = b
+	}
+	h.fresh = false
+	return window(h.snap, off, count), nil
+}
+
+func (h *itemHandle) WriteAt(data []byte, off uint64) (uint32, error) {
+	if h.write == nil {
+		return 0, ErrReadOnly
+	}
+	if err := h.write(data, off); err != nil {
+		return 0, err
+	}
+	h.Lock()
+	h.fresh = false // the next read at 0 shows the write
+	h.Unlock()
+	return uint32(len(data)), nil
+}
+
+func (h *itemHandle) Clunk() {}
+
+// window returns the part of b a read at off for count bytes sees.
+func window(b []byte, off uint64, count uint32) []byte {
+	if off >= uint64(len(b)) {
+		return nil
+	}
+	b = b[off:]
+	if len(b) > int(count) {
+		b = b[:count]
+	}
+	return b
+}
+
+// werror converts an object's error to a warp9 error; def is used for
+// errors that are not warp9 errors already.
+func werror(err error, def int16) *warp9.WarpError {
+	if we, ok := err.(*warp9.WarpError); ok {
+		return we
+	}
+	if err == ErrReadOnly {
+		return warp9.Error(warp9.Eperm)
+	}
+	return warp9.Error(def)
+}
@@ -0,0 +1,53 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package sensim
+
+import (
+	"strconv"
+	"testing"
+)
+
+// counting is an Item whose content changes on every Read.
+type counting struct{ n int }
+
+func (c *counting) Stat(dir *SenDir) error { return nil }
+
+func (c *counting) Read() ([]byte, error) {
+	c.n++
+	return []byte(strconv.Itoa(c.n*1000 + c.n)), nil
+}
+
+type liveCounting struct{ counting }
+
+func (c *liveCounting) Live() bool { return true }
+
+// Items need not implement Live; those that don't are snapshots.
+func TestItemSnapshot(t *testing.T) {
+	for _, tc := range []struct {
+		it   Item
+		want []string // reads at 0, 2, 0
+	}{
+		{&counting{}, []string{"1001", "01", "2002"}},
+		{&liveCounting{}, []string{"1001", "02", "3003"}},
+	} {
+		h, err := openItem(tc.it, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, off := range []uint64{0, 2, 0} {
+			b, err := h.ReadAt(off, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, string(b))
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("%T: reads %q, want %q", tc.it, got, tc.want)
+				break
+			}
+		}
+	}
+}
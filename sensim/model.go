@@ -0,0 +1,412 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package sensim
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Model produces the signal of a simulated sensor. Sample is called
+// with non-decreasing times; models measure time from their first
+// sample so a given seed and sequence of times always yields the
+// same values.
+type Model interface {
+	Sample(t time.Time) float64
+}
+
+// Setter is implemented by models whose current value can be forced
+// (the ctl set-value command).
+type Setter interface {
+	Set(v float64)
+}
+
+// epoch records the time of a model's first sample.
+type epoch struct {
+	t0  time.Time
+	set bool
+}
+
+func (e *epoch) since(t time.Time) time.Duration {
+	if !e.set {
+		e.t0, e.set = t, true
+	}
+	return t.Sub(e.t0)
+}
+
+// Constant always returns Value.
+type Constant struct {
+	Value float64
+}
+
+func (c *Constant) Sample(t time.Time) float64 { return c.Value }
+func (c *Constant) Set(v float64)              { c.Value = v }
+
+// Sawtooth climbs by Step each sample and drops back to Min once
+// past Max. This is the classic sensim reading.
+type Sawtooth struct {
+	Value, Min, Max, Step float64
+}
+
+func (s *Sawtooth) Sample(t time.Time) float64 {
+	if s.Value > s.Max {
+		s.Value = s.Min
+	}
+	s.Value += s.Step
+	return s.Value
+}
+
+func (s *Sawtooth) Set(v float64) { s.Value = v }
+
+// Sine oscillates around Offset.
+type Sine struct {
+	Offset, Amplitude float64
+	Period            time.Duration
+	Phase             float64 // radians
+	epoch
+}
+
+func (s *Sine) Sample(t time.Time) float64 {
+	x := float64(s.since(t)) / float64(s.Period)
+	return s.Offset + s.Amplitude*math.Sin(2*math.Pi*x+s.Phase)
+}
+
+// NewDiurnal returns a daily cycle between min and max, peaking at
+// peak hours after the first sample.
+func NewDiurnal(min, max float64, peak time.Duration) *Sine {
+	day := 24 * time.Hour
+	return &Sine{
+		Offset:    (max + min) / 2,
+		Amplitude: (max - min) / 2,
+		Period:    day,
+		Phase:     math.Pi/2 - 2*math.Pi*float64(peak)/float64(day),
+	}
+}
+
+// RandomWalk moves by up to Step per sample, reflecting off Min and Max.
+type RandomWalk struct {
+	Value, Step, Min, Max float64
+	rng                   *rand.Rand
+}
+
+func NewRandomWalk(start, step, min, max float64, seed int64) *RandomWalk {
+	return &RandomWalk{start, step, min, max, rand.New(rand.NewSource(seed))}
+}
+
+func (w *RandomWalk) Sample(t time.Time) float64 {
+	w.Value += (w.rng.Float64()*2 - 1) * w.Step
+	if w.Value > w.Max {
+		w.Value = 2*w.Max - w.Value
+	}
+	if w.Value < w.Min {
+		w.Value = 2*w.Min - w.Value
+	}
+	return w.Value
+}
+
+func (w *RandomWalk) Set(v float64) { w.Value = v }
+
+// Noise adds Gaussian noise to another model.
+type Noise struct {
+	Base   Model
+	StdDev float64
+	rng    *rand.Rand
+}
+
+func NewNoise(base Model, stddev float64, seed int64) *Noise {
+	return &Noise{base, stddev, rand.New(rand.NewSource(seed))}
+}
+
+func (n *Noise) Sample(t time.Time) float64 {
+	return n.Base.Sample(t) + n.rng.NormFloat64()*n.StdDev
+}
+
+// StepChange sets the output to Value once After has elapsed.
+type StepChange struct {
+	After time.Duration
+	Value float64
+}
+
+// Step holds Initial until the first change; Changes are in
+// increasing After order.
+type Step struct {
+	Initial float64
+	Changes []StepChange
+	epoch
+}
+
+func (s *Step) Sample(t time.Time) float64 {
+	d := s.since(t)
+	v := s.Initial
+	for _, c := range s.Changes {
+		if d < c.After {
+			break
+		}
+		v = c.Value
+	}
+	return v
+}
+
+// StuckAt is a fault: it follows Base until After has elapsed, then
+// repeats the last value forever.
+type StuckAt struct {
+	Base  Model
+	After time.Duration
+	last  float64
+	stuck bool
+	epoch
+}
+
+func (s *StuckAt) Sample(t time.Time) float64 {
+	d := s.since(t)
+	if s.stuck {
+		return s.last
+	}
+	s.last = s.Base.Sample(t)
+	s.stuck = d >= s.After
+	return s.last
+}
+
+// Drift is a fault: after After has elapsed Base is offset by an
+// error growing at Rate units per hour.
+type Drift struct {
+	Base  Model
+	After time.Duration
+	Rate  float64
+	epoch
+}
+
+func (d *Drift) Sample(t time.Time) float64 {
+	v := d.Base.Sample(t)
+	if e := d.since(t) - d.After; e > 0 {
+		v += d.Rate * e.Hours()
+	}
+	return v
+}
+
+// Replay plays back recorded values. Each point applies from its
+// offset until the next; after the last point the final value is
+// held, or playback restarts if Loop is set.
+type Replay struct {
+	Points []StepChange
+	Loop   bool
+	epoch
+}
+
+// LoadCSV reads "offset,value" rows; offset is seconds or a Go
+// duration (e.g. 1m30s) from the start of the recording.
+func LoadCSV(file string, loop bool) (*Replay, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	r := &Replay{Loop: loop}
+	for i, row := range rows {
+		if len(row) < 2 {
+			return nil, fmt.Errorf("%s:%d: want offset,value", file, i+1)
+		}
+		off, err := parseOffset(row[0])
+		if err != nil {
+			if i == 0 {
+				continue // header
+			}
+			return nil, fmt.Errorf("%s:%d: %v", file, i+1, err)
+		}
+		v, err := strconv.ParseFloat(row[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, i+1, err)
+		}
+		r.Points = append(r.Points, StepChange{off, v})
+	}
+	if len(r.Points) == 0 {
+		return nil, errors.New(file + ": no data")
+	}
+	return r, nil
+}
+
+func parseOffset(s string) (time.Duration, error) {
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(secs * float64(time.Second)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+func (r *Replay) Sample(t time.Time) float64 {
+	d := r.since(t)
+	if n := len(r.Points); r.Loop {
+		// the last point lasts as long as the gap before it
+		length := r.Points[n-1].After + time.Second
+		if n > 1 {
+			length = 2*r.Points[n-1].After - r.Points[n-2].After
+		}
+		if length > 0 {
+			d %= length
+		}
+	}
+	v := r.Points[0].Value
+	for _, p := range r.Points {
+		if d < p.After {
+			break
+		}
+		v = p.Value
+	}
+	return v
+}
+
+// Input is a signal a model can follow, such as an actuator's state.
+type Input interface {
+	Level(t time.Time) float64
+}
+
+// Track is a first-order lag: each sample moves the value a fraction
+// Gain of the way towards its target, like a room warming towards a
+// heater setpoint. The target is the Input level mapped onto
+// Low..High, or the level itself if Low and High are equal.
+type Track struct {
+	Value     float64
+	Gain      float64
+	Low, High float64
+	Input     Input
+}
+
+func (tr *Track) Sample(t time.Time) float64 {
+	target := tr.Input.Level(t)
+	if tr.Low != tr.High {
+		target = tr.Low + (tr.High-tr.Low)*target
+	}
+	tr.Value += (target - tr.Value) * tr.Gain
+	return tr.Value
+}
+
+func (tr *Track) Set(v float64) { tr.Value = v }
+
+// ModelSpec describes a model and its parameters, e.g. in a scenario
+// file. Fields not used by a model type are ignored; Base is the
+// model wrapped by noise, stuck and drift; Input is the path of the
+// actuator a track model follows.
+type ModelSpec struct {
+	Type      string     `json:"type"` // const, sawtooth, sine, diurnal, walk, noise, step, stuck, drift, csv, track
+	Value     float64    `json:"value"`
+	Min       float64    `json:"min"`
+	Max       float64    `json:"max"`
+	Step      float64    `json:"step"`
+	Amplitude float64    `json:"amplitude"`
+	Period    Duration   `json:"period"`
+	Phase     float64    `json:"phase"`
+	Peak      Duration   `json:"peak"`
+	StdDev    float64    `json:"stddev"`
+	After     Duration   `json:"after"`
+	Rate      float64    `json:"rate"`
+	Changes   []StepSpec `json:"changes"`
+	File      string     `json:"file"`
+	Loop      bool       `json:"loop"`
+	Seed      int64      `json:"seed"`
+	Base      *ModelSpec `json:"base"`
+	Input     string     `json:"input"`
+	Gain      float64    `json:"gain"`
+}
+
+type StepSpec struct {
+	After Duration `json:"after"`
+	Value float64  `json:"value"`
+}
+
+// Duration is a time.Duration written as a string ("90s") in JSON.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	s, err := strconv.Unquote(string(b))
+	if err != nil {
+		return fmt.Errorf("duration must be a string: %s", b)
+	}
+	v, err := time.ParseDuration(s)
+	*d = Duration(v)
+	return err
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(time.Duration(d).String())), nil
+}
+
+// NewModel builds the model described by spec. Track models need a
+// device to find their input and can't be built this way.
+func NewModel(spec *ModelSpec) (Model, error) {
+	return newModel(spec, nil)
+}
+
+// newModel builds the model described by spec; link finds the
+// inputs of track models.
+func newModel(spec *ModelSpec, link func(path string) (Input, error)) (Model, error) {
+	var base Model
+	switch spec.Type {
+	case "noise", "stuck", "drift":
+		if spec.Base == nil {
+			return nil, fmt.Errorf("%s model needs a base model", spec.Type)
+		}
+		var err error
+		if base, err = newModel(spec.Base, link); err != nil {
+			return nil, err
+		}
+	}
+
+	switch spec.Type {
+	case "const":
+		return &Constant{spec.Value}, nil
+	case "", "sawtooth":
+		return defaultModel(), nil
+	case "sine":
+		if spec.Period <= 0 {
+			return nil, errors.New("sine model needs a period")
+		}
+		return &Sine{Offset: spec.Value, Amplitude: spec.Amplitude, Period: time.Duration(spec.Period), Phase: spec.Phase}, nil
+	case "diurnal":
+		return NewDiurnal(spec.Min, spec.Max, time.Duration(spec.Peak)), nil
+	case "walk":
+		return NewRandomWalk(spec.Value, spec.Step, spec.Min, spec.Max, spec.Seed), nil
+	case "noise":
+		return NewNoise(base, spec.StdDev, spec.Seed), nil
+	case "step":
+		s := &Step{Initial: spec.Value}
+		for _, c := range spec.Changes {
+			s.Changes = append(s.Changes, StepChange{time.Duration(c.After), c.Value})
+		}
+		return s, nil
+	case "stuck":
+		return &StuckAt{Base: base, After: time.Duration(spec.After)}, nil
+	case "drift":
+		return &Drift{Base: base, After: time.Duration(spec.After), Rate: spec.Rate}, nil
+	case "csv":
+		return LoadCSV(spec.File, spec.Loop)
+	case "track":
+		if link == nil {
+			return nil, errors.New("track model needs a device")
+		}
+		if spec.Gain <= 0 || spec.Gain > 1 {
+			return nil, errors.New("track model needs a gain within (0,1]")
+		}
+		in, err := link(spec.Input)
+		if err != nil {
+			return nil, err
+		}
+		return &Track{Value: spec.Value, Gain: spec.Gain, Low: spec.Min, High: spec.Max, Input: in}, nil
+	}
+	return nil, fmt.Errorf("unknown model type: %s", spec.Type)
+}
+
+// defaultModel is the reading sensim has always produced.
+func defaultModel() Model {
+	return &Sawtooth{Value: initialTemp, Min: 28, Max: 50, Step: 5}
+}
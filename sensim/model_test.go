@@ -0,0 +1,78 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package sensim
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// samples takes n samples of spec's model, one every step from t0.
+func samples(t *testing.T, spec *ModelSpec, n int, step time.Duration) []float64 {
+	t.Helper()
+	m, err := NewModel(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Unix(1000, 0)
+	out := make([]float64, n)
+	for i := range out {
+		out[i] = m.Sample(t0.Add(time.Duration(i) * step))
+	}
+	return out
+}
+
+// Models built from the same seed produce the same signal.
+func TestSeededModels(t *testing.T) {
+	for _, spec := range []*ModelSpec{
+		{Type: "walk", Value: 20, Step: 1, Min: 15, Max: 25, Seed: 7},
+		{Type: "noise", StdDev: 1, Seed: 3, Base: &ModelSpec{Type: "sine", Value: 20, Amplitude: 5, Period: Duration(time.Minute)}},
+	} {
+		a := samples(t, spec, 50, time.Second)
+		if b := samples(t, spec, 50, time.Second); !reflect.DeepEqual(a, b) {
+			t.Errorf("%s: seed %d gave %v, then %v", spec.Type, spec.Seed, a, b)
+		}
+		other := *spec
+		other.Seed++
+		if b := samples(t, &other, 50, time.Second); reflect.DeepEqual(a, b) {
+			t.Errorf("%s: seeds %d and %d gave the same signal", spec.Type, spec.Seed, other.Seed)
+		}
+	}
+
+	// a walk stays within its bounds
+	for i, v := range samples(t, &ModelSpec{Type: "walk", Value: 20, Step: 3, Min: 15, Max: 25, Seed: 9}, 1000, time.Second) {
+		if v < 15 || v > 25 {
+			t.Fatalf("sample %d: %v outside 15..25", i, v)
+		}
+	}
+}
+
+// Time-based models measure from their first sample.
+func TestTimedModels(t *testing.T) {
+	dir := t.TempDir()
+	csv := filepath.Join(dir, "r.csv")
+	if err := os.WriteFile(csv, []byte("offset,value\n0,1\n10,2\n20,3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		spec *ModelSpec
+		want []float64 // one sample every 10s
+	}{
+		{&ModelSpec{Type: "step", Value: 1, Changes: []StepSpec{{Duration(20 * time.Second), 9}}},
+			[]float64{1, 1, 9, 9}},
+		{&ModelSpec{Type: "drift", After: Duration(10 * time.Second), Rate: 3600, Base: &ModelSpec{Type: "const", Value: 5}},
+			[]float64{5, 5, 15, 25}},
+		{&ModelSpec{Type: "stuck", After: Duration(10 * time.Second), Base: &ModelSpec{Type: "sawtooth"}},
+			[]float64{37.8, 42.8, 42.8, 42.8}},
+		{&ModelSpec{Type: "csv", File: csv}, []float64{1, 2, 3, 3, 3}},
+		{&ModelSpec{Type: "csv", File: csv, Loop: true}, []float64{1, 2, 3, 1, 2}},
+	} {
+		if got := samples(t, tc.spec, len(tc.want), 10*time.Second); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.spec.Type, got, tc.want)
+		}
+	}
+}
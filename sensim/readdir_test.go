@@ -0,0 +1,99 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package sensim
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/lavaorg/warp/warp9"
+)
+
+// list reads fid's whole listing count bytes at a time, checking each
+// read holds only whole entries.
+func list(t *testing.T, srv *SenSrv, fid *senFid, count uint32) []string {
+	t.Helper()
+	var names []string
+	for off := uint64(0); ; {
+		b, err := readdir(srv, fid, off, count)
+		if err != nil {
+			t.Fatalf("read at %d: %v", off, err)
+		}
+		if len(b) == 0 {
+			return names
+		}
+		if len(b) > int(count) {
+			t.Fatalf("read of %d returned %d bytes", count, len(b))
+		}
+		off += uint64(len(b))
+		for len(b) > 0 {
+			d, rest, _, err := warp9.UnpackDir(b)
+			if err != nil {
+				t.Fatalf("read at %d: partial entry: %v", off, err)
+			}
+			names = append(names, d.Name)
+			b = rest
+		}
+	}
+}
+
+func TestReaddir(t *testing.T) {
+	srv := newSenSrv("dir", 0)
+	for _, p := range []string{"zeta", "alpha", "mid/x", "beta", "gamma"} {
+		if err := srv.AddSensor(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"alpha", "beta", "gamma", "mid", "zeta"}
+
+	// a count too small for a second entry returns one at a time
+	one := len(warp9.PackDir(&srv.lookup("alpha").Dir))
+	for _, count := range []uint32{uint32(one), uint32(one) + 10, 8192} {
+		names := list(t, srv, &senFid{entry: srv.root}, count)
+		if !reflect.DeepEqual(names, want) {
+			t.Errorf("count %d: got %v, want %v", count, names, want)
+		}
+	}
+
+	fid := &senFid{entry: srv.root}
+	if _, err := readdir(srv, fid, 0, 10); !reflect.DeepEqual(err, warp9.Error(warp9.Ebufsmall)) {
+		t.Errorf("count below one entry: %v, want Ebufsmall", err)
+	}
+	if _, err := readdir(srv, fid, 3, 8192); !reflect.DeepEqual(err, warp9.Error(warp9.Ebadoffset)) {
+		t.Errorf("offset inside an entry: %v, want Ebadoffset", err)
+	}
+}
+
+// Each fid continues in the listing it started, whatever changes.
+func TestReaddirContinuity(t *testing.T) {
+	srv := newSenSrv("dir", 0)
+	for _, p := range []string{"b", "d"} {
+		if err := srv.AddSensor(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fid := &senFid{entry: srv.root}
+	b, err := readdir(srv, fid, 0, uint32(len(warp9.PackDir(&srv.lookup("b").Dir))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an entry sorted before the offset would shift a fresh listing
+	srv.AddSensor("a")
+	rest, err := readdir(srv, fid, uint64(len(b)), 8192)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, _, _, err := warp9.UnpackDir(rest); err != nil || d.Name != "d" {
+		t.Errorf("continued listing at %v, %v; want d", d, err)
+	}
+
+	// starting over, or another fid, sees the change
+	if names := list(t, srv, fid, 8192); len(names) != 3 {
+		t.Errorf("listing from offset 0: %v", names)
+	}
+	if names := list(t, srv, &senFid{entry: srv.root}, 8192); len(names) != 3 {
+		t.Errorf("new fid: %v", names)
+	}
+}
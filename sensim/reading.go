@@ -0,0 +1,303 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package sensim
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reading is one sample of a sensor.
+type Reading struct {
+	Time    time.Time `json:"time"` // device clock time of the sample
+	Seq     uint64    `json:"seq"`  // sample number since reset
+	Value   float64   `json:"value"`
+	Unit    string    `json:"unit"`
+	Quality string    `json:"quality"` // good, or forced after set-value
+}
+
+// Encodings a sensor can serve its readings in:
+//
+//	value -- the bare value, "%f" (the default)
+//	text  -- "time seq value unit quality\n"
+//	json  -- one JSON object per line
+//	cbor  -- a CBOR map with the JSON field names
+//
+// Besides the sensor's own setting, every encoding but value is
+// reachable by walking to the sensor name plus a suffix, e.g.
+// "sensors.json"; such names are not listed by readdir. Likewise
+// "sensors.history" serves the recent readings (see historyItem) and
+// "sensors.next" each new one as it is taken (see nextItem).
+var encoders = map[string]func(*Reading) ([]byte, error){
+	"value": encodeValue,
+	"text":  encodeText,
+	"json":  encodeJSON,
+	"cbor":  encodeCBOR,
+}
+
+var encodingSuffix = map[string]string{
+	".txt":  "text",
+	".json": "json",
+	".cbor": "cbor",
+}
+
+func checkEncoding(enc string) error {
+	if _, ok := encoders[enc]; !ok {
+		return fmt.Errorf("unknown encoding: %s", enc)
+	}
+	return nil
+}
+
+// Encode returns r in encoding enc.
+func (r *Reading) Encode(enc string) ([]byte, error) {
+	f, ok := encoders[enc]
+	if !ok {
+		return nil, fmt.Errorf("unknown encoding: %s", enc)
+	}
+	return f(r)
+}
+
+func encodeValue(r *Reading) ([]byte, error) {
+	return []byte(fmt.Sprintf("%f", r.Value)), nil
+}
+
+func encodeText(r *Reading) ([]byte, error) {
+	unit := r.Unit
+	if unit == "" {
+		unit = "-"
+	}
+	return []byte(fmt.Sprintf("%s %d %f %s %s\n", r.Time.UTC().Format(time.RFC3339Nano), r.Seq, r.Value, unit, r.Quality)), nil
+}
+
+func encodeJSON(r *Reading) ([]byte, error) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// encodeCBOR writes r as a CBOR (RFC 7049) map. The time is an
+// epoch-based date/time (tag 1) in floating point seconds.
+func encodeCBOR(r *Reading) ([]byte, error) {
+	b := cborHead(nil, 5, 5)
+	b = cborText(b, "time")
+	b = cborHead(b, 6, 1)
+	b = cborFloat(b, float64(r.Time.UnixNano())/1e9)
+	b = cborText(b, "seq")
+	b = cborHead(b, 0, r.Seq)
+	b = cborText(b, "value")
+	b = cborFloat(b, r.Value)
+	b = cborText(b, "unit")
+	b = cborText(b, r.Unit)
+	b = cborText(b, "quality")
+	b = cborText(b, r.Quality)
+	return b, nil
+}
+
+// cborHead appends the initial bytes of an item of major type mt
+// with argument n.
+func cborHead(b []byte, mt byte, n uint64) []byte {
+	mt <<= 5
+	switch {
+	case n < 24:
+		return append(b, mt|byte(n))
+	case n <= math.MaxUint8:
+		return append(b, mt|24, byte(n))
+	case n <= math.MaxUint16:
+		return cborUint(append(b, mt|25), n, 2)
+	case n <= math.MaxUint32:
+		return cborUint(append(b, mt|26), n, 4)
+	}
+	return cborUint(append(b, mt|27), n, 8)
+}
+
+// cborUint appends the low size bytes of n, big endian.
+func cborUint(b []byte, n uint64, size int) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], n)
+	return append(b, buf[8-size:]...)
+}
+
+func cborText(b []byte, s string) []byte {
+	return append(cborHead(b, 3, uint64(len(s))), s...)
+}
+
+func cborFloat(b []byte, f float64) []byte {
+	return cborUint(append(b, 0xfb), math.Float64bits(f), 8)
+}
+
+// sensorView serves a sensor's readings in a fixed encoding.
+type sensorView struct {
+	s   *sensorItem
+	enc string
+}
+
+func (v *sensorView) Stat(dir *SenDir) error { return nil }
+
+func (v *sensorView) Read() ([]byte, error) {
+	r := v.s.reading()
+	return r.Encode(v.enc)
+}
+
+// historyItem serves the history of a sensor. The read offset is
+// the sequence number of the first reading wanted; each read returns
+// as many whole readings, in text encoding, as fit. A reader resumes
+// at the sequence number after the last one it got. Offsets older
+// than the history start at the oldest reading held.
+type historyItem struct {
+	s *sensorItem
+}
+
+func (h *historyItem) Stat(dir *SenDir) error { return nil }
+
+// Open returns h itself: reads keep no state between them.
+func (h *historyItem) Open(dir *SenDir, mode uint8) (Handle, error) { return h, nil }
+
+func (h *historyItem) ReadAt(off uint64, count uint32) ([]byte, error) {
+	var buf []byte
+	for _, r := range h.s.history(off, int(count)) {
+		b, _ := encodeText(&r)
+		if len(buf)+len(b) > int(count) {
+			if len(buf) == 0 {
+				return nil, fmt.Errorf("read count too small for a reading")
+			}
+			break
+		}
+		buf = append(buf, b...)
+	}
+	return buf, nil
+}
+
+func (h *historyItem) WriteAt(data []byte, off uint64) (uint32, error) { return 0, ErrReadOnly }
+func (h *historyItem) Clunk()                                          {}
+
+// nextItem serves each reading of a sensor once, as it is taken.
+// A read blocks until the sensor takes a sample newer than the last
+// one returned on the fid, and returns it in the sensor's encoding;
+// it fails with ErrNoReading if none comes within the sensor's wait
+// limit. Offsets are ignored. Flushing the read cancels it.
+type nextItem struct {
+	s *sensorItem
+}
+
+func (n *nextItem) Stat(dir *SenDir) error { return nil }
+
+func (n *nextItem) Open(dir *SenDir, mode uint8) (Handle, error) {
+	return &nextHandle{s: n.s}, nil
+}
+
+// ErrNoReading fails a read of a next object that waited its limit.
+// An empty read would look like the end of the object.
+var ErrNoReading = errors.New("no new reading")
+
+// nextHandle remembers the last reading returned on its fid.
+type nextHandle struct {
+	sync.Mutex
+	s    *sensorItem
+	seen uint64 // sequence number of the last reading returned
+}
+
+// ReadAt does not block; it returns the latest reading.
+func (h *nextHandle) ReadAt(off uint64, count uint32) ([]byte, error) {
+	b, err := h.s.Read()
+	return window(b, 0, count), err
+}
+
+func (h *nextHandle) ReadWait(off uint64, count uint32, cancel <-chan struct{}) ([]byte, error) {
+	h.Lock()
+	seen := h.seen
+	h.Unlock()
+	if seen == 0 {
+		seen = h.s.reading().Seq
+	}
+
+	h.s.Lock()
+	timeout := h.s.nextWait
+	h.s.Unlock()
+	r := h.s.wait(seen, cancel, timeout)
+	if r == nil {
+		select {
+		case <-cancel:
+			return nil, nil // flushed; nobody reads the answer
+		default:
+			return nil, ErrNoReading
+		}
+	}
+	b, err := r.Encode(h.s.format())
+	if err != nil {
+		return nil, err
+	}
+
+	h.Lock()
+	if r.Seq > h.seen {
+		h.seen = r.Seq
+	}
+	h.Unlock()
+	return window(b, 0, count), nil
+}
+
+func (h *nextHandle) WriteAt(data []byte, off uint64) (uint32, error) { return 0, ErrReadOnly }
+func (h *nextHandle) Clunk()                                          {}
+
+// Companion objects of a sensor, e.g. "sensors.history".
+const (
+	historySuffix = ".history"
+	nextSuffix    = ".next"
+)
+
+// view resolves "name.suffix" in directory d to an encoded view or
+// the history of the sensor name, or returns nil. Views are made on
+// first use.
+func (srv *SenSrv) view(d *SenDir, name string) *SenDir {
+	i := strings.LastIndexByte(name, '.')
+	if i <= 0 {
+		return nil
+	}
+	enc, ok := encodingSuffix[name[i:]]
+	switch name[i:] {
+	case historySuffix:
+		enc, ok = "history", true
+	case nextSuffix:
+		enc, ok = "next", true
+	}
+	if !ok {
+		return nil
+	}
+	sdir := srv.walk1(d, name[:i])
+	if sdir == nil {
+		return nil
+	}
+	s, ok := sdir.item.(*sensorItem)
+	if !ok {
+		return nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if v := s.views[enc]; v != nil {
+		return v
+	}
+	v := srv.newSenDir(name, false)
+	switch enc {
+	case "history":
+		v.item = &historyItem{s}
+	case "next":
+		v.item = &nextItem{s}
+	default:
+		v.item = &sensorView{s, enc}
+	}
+	v.parent = d
+	if s.views == nil {
+		s.views = make(map[string]*SenDir)
+	}
+	s.views[enc] = v
+	return v
+}
@@ -0,0 +1,223 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package sensim
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lavaorg/warp/warp9"
+)
+
+// A read of a next object that gets no reading fails, rather than
+// returning no data.
+func TestNextTimeout(t *testing.T) {
+	srv := NewSenSrv("next", 0)
+	srv.SetClock(NewVirtualClock(time.Unix(1000, 0)))
+	s := testSensor(t, srv)
+	s.setNextWait(10 * time.Millisecond)
+
+	h := &nextHandle{s: s}
+	if b, err := h.ReadWait(0, 100, make(chan struct{})); err != ErrNoReading {
+		t.Errorf("got %q, %v; want %v", b, err, ErrNoReading)
+	}
+}
+
+// A Tflush that arrives while the read is still on its way to block
+// cancels it all the same.
+func TestNextEarlyFlush(t *testing.T) {
+	srv := NewSenSrv("next", 0)
+	srv.SetClock(NewVirtualClock(time.Unix(1000, 0)))
+	testSensor(t, srv)
+	c := dial(t, start(t, srv))
+
+	c.send(warp9.Twalk, 2, u32(0), u32(1), u16(1), str("temp"+nextSuffix))
+	c.expect(warp9.Rwalk, 2)
+	c.send(warp9.Topen, 2, u32(1), []byte{warp9.OREAD})
+	c.expect(warp9.Ropen, 2)
+
+	// hold the read up before it blocks
+	if err := srv.AddFault(&Fault{Kind: "delay", Op: "read", Delay: Duration(100 * time.Millisecond)}); err != nil {
+		t.Fatal(err)
+	}
+	c.send(warp9.Tread, 3, u32(1), u32(0), u32(0), u32(100))
+	time.Sleep(20 * time.Millisecond)
+	c.send(warp9.Tflush, 4, u16(3))
+	c.expect(warp9.Rflush, 4)
+	c.send(warp9.Tclunk, 5, u32(1))
+	c.expect(warp9.Rclunk, 5)
+}
+
+// cbor decodes the items encodeCBOR writes: unsigned ints, text,
+// maps, tags and doubles. Maps decode to map[string]interface{}.
+type cbor struct {
+	b   []byte
+	err error
+}
+
+func (d *cbor) head() (byte, uint64) {
+	if d.err != nil || len(d.b) == 0 {
+		d.fail("short input")
+		return 0, 0
+	}
+	mt, info := d.b[0]>>5, d.b[0]&31
+	d.b = d.b[1:]
+	size := 0
+	switch {
+	case info < 24:
+		return mt, uint64(info)
+	case info <= 27:
+		size = 1 << (info - 24)
+	default:
+		d.fail(fmt.Sprintf("additional info %d", info))
+		return 0, 0
+	}
+	if len(d.b) < size {
+		d.fail("short argument")
+		return 0, 0
+	}
+	var buf [8]byte
+	copy(buf[8-size:], d.b[:size])
+	d.b = d.b[size:]
+	return mt, binary.BigEndian.Uint64(buf[:])
+}
+
+func (d *cbor) fail(msg string) {
+	if d.err == nil {
+		d.err = fmt.Errorf("cbor: %s", msg)
+	}
+}
+
+func (d *cbor) item() interface{} {
+	if len(d.b) > 0 && d.b[0] == 0xfb {
+		if len(d.b) < 9 {
+			d.fail("short double")
+			return nil
+		}
+		f := math.Float64frombits(binary.BigEndian.Uint64(d.b[1:9]))
+		d.b = d.b[9:]
+		return f
+	}
+	mt, n := d.head()
+	switch mt {
+	case 0:
+		return n
+	case 3:
+		if uint64(len(d.b)) < n {
+			d.fail("short text")
+			return nil
+		}
+		s := string(d.b[:n])
+		d.b = d.b[n:]
+		return s
+	case 5:
+		m := make(map[string]interface{})
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			k, ok := d.item().(string)
+			if !ok {
+				d.fail("key is not text")
+			}
+			m[k] = d.item()
+		}
+		return m
+	case 6:
+		return map[uint64]interface{}{n: d.item()}
+	}
+	d.fail(fmt.Sprintf("major type %d", mt))
+	return nil
+}
+
+// CBOR readings decode to the reading, whatever the size of its
+// numbers.
+func TestEncodeCBOR(t *testing.T) {
+	t0 := time.Unix(1600000000, 250000000)
+	for _, r := range []Reading{
+		{Time: t0, Seq: 0, Value: 21.5, Unit: "C", Quality: "good"},
+		{Time: t0, Seq: 23, Value: -40.125, Unit: "", Quality: "forced"},
+		{Time: t0, Seq: 255, Value: -1e-9, Unit: "kPa", Quality: "good"},
+		{Time: t0, Seq: 65535 + 1, Value: math.Inf(-1), Unit: "C", Quality: "good"},
+		{Time: t0, Seq: 1 << 40, Value: math.NaN(), Unit: strings.Repeat("u", 300), Quality: "good"},
+		{Time: t0, Seq: math.MaxUint64, Value: 0, Unit: "C", Quality: "good"},
+	} {
+		b, err := encodeCBOR(&r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := &cbor{b: b}
+		m, _ := d.item().(map[string]interface{})
+		if d.err != nil || len(d.b) != 0 || len(m) != 5 {
+			t.Errorf("seq %d: decoded %v, %v, %d bytes left", r.Seq, m, d.err, len(d.b))
+			continue
+		}
+		tm, _ := m["time"].(map[uint64]interface{})
+		if secs, ok := tm[1].(float64); !ok || secs != float64(t0.UnixNano())/1e9 {
+			t.Errorf("seq %d: time %v, want tag 1 of %v", r.Seq, m["time"], float64(t0.UnixNano())/1e9)
+		}
+		if seq, ok := m["seq"].(uint64); !ok || seq != r.Seq {
+			t.Errorf("seq %d: decoded seq %v", r.Seq, m["seq"])
+		}
+		v, ok := m["value"].(float64)
+		if !ok || v != r.Value && !(math.IsNaN(v) && math.IsNaN(r.Value)) {
+			t.Errorf("seq %d: value %v, want %v", r.Seq, m["value"], r.Value)
+		}
+		if m["unit"] != r.Unit || m["quality"] != r.Quality {
+			t.Errorf("seq %d: unit %v quality %v", r.Seq, m["unit"], m["quality"])
+		}
+	}
+}
+
+// The .json and .txt views of a sensor parse back to its reading.
+func TestEncodedViews(t *testing.T) {
+	srv := NewSenSrv("views", 0)
+	srv.SetClock(NewVirtualClock(time.Unix(1600000000, 0)))
+	s := testSensor(t, srv)
+	s.set(-3.25)
+	s.setUnit("C")
+	want := s.reading()
+
+	read := func(name string) []byte {
+		t.Helper()
+		v := srv.view(srv.root, name)
+		if v == nil {
+			t.Fatalf("no view %s", name)
+		}
+		b, err := v.item.(*sensorView).Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	var got Reading
+	if err := json.Unmarshal(read("temp.json"), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !got.Time.Equal(want.Time) || got.Seq != want.Seq || got.Value != want.Value || got.Unit != want.Unit || got.Quality != want.Quality {
+		t.Errorf("json view %+v, want %+v", got, want)
+	}
+
+	f := strings.Fields(string(read("temp.txt")))
+	if len(f) != 5 {
+		t.Fatalf("text view has %d fields", len(f))
+	}
+	tm, err := time.Parse(time.RFC3339Nano, f[0])
+	if err != nil || !tm.Equal(want.Time) {
+		t.Errorf("text view time %s, want %v", f[0], want.Time)
+	}
+	if seq, _ := strconv.ParseUint(f[1], 10, 64); seq != want.Seq {
+		t.Errorf("text view seq %s, want %d", f[1], want.Seq)
+	}
+	if v, _ := strconv.ParseFloat(f[2], 64); v != want.Value {
+		t.Errorf("text view value %s, want %v", f[2], want.Value)
+	}
+	if f[3] != "C" || f[4] != want.Quality {
+		t.Errorf("text view unit %s quality %s", f[3], f[4])
+	}
+}
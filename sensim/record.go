@@ -0,0 +1,215 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package sensim
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lavaorg/warp/warp9"
+)
+
+// SessionEntry is one request and its response, as captured by a
+// Recorder. Session files hold one JSON entry per line. Paths are
+// relative to the root the client attached to.
+type SessionEntry struct {
+	At      Duration   `json:"at"`   // since the recording started
+	Conn    int        `json:"conn"` // connection number
+	Op      string     `json:"op"`   // attach, walk, open, read, write, stat
+	Path    string     `json:"path"`
+	Mode    uint8      `json:"mode,omitempty"`
+	Offset  uint64     `json:"offset,omitempty"`
+	Count   uint32     `json:"count,omitempty"` // asked for by reads, done by writes
+	Data    []byte     `json:"data,omitempty"`  // read or written
+	Dir     *warp9.Dir `json:"dir,omitempty"`   // stat result
+	Errno   int16      `json:"errno,omitempty"` // Rerror code
+	Error   string     `json:"error,omitempty"`
+	Latency Duration   `json:"latency"`
+}
+
+// Recorder sits between a real warp9 device and its client, passing
+// every message through unchanged and writing a SessionEntry for each
+// answered request.
+type Recorder struct {
+	mu    sync.Mutex
+	w     *json.Encoder
+	start time.Time
+	conns int
+}
+
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: json.NewEncoder(w), start: time.Now()}
+}
+
+// recConn is the state of one recorded connection.
+type recConn struct {
+	rec     *Recorder
+	id      int
+	mu      sync.Mutex
+	fids    map[uint32]string // fid to path
+	pending map[uint16]*pendingReq
+}
+
+type pendingReq struct {
+	fc *warp9.Fcall
+	at time.Time
+}
+
+// Record relays messages between a and b until either side closes,
+// recording the session. Either side may be the device: requests
+// are told from responses by their type.
+func (r *Recorder) Record(a, b net.Conn) error {
+	r.mu.Lock()
+	r.conns++
+	rc := &recConn{rec: r, id: r.conns, fids: make(map[uint32]string), pending: make(map[uint16]*pendingReq)}
+	r.mu.Unlock()
+
+	errc := make(chan error, 2)
+	go func() { errc <- rc.relay(a, b) }()
+	go func() { errc <- rc.relay(b, a) }()
+	err := <-errc
+	a.Close()
+	b.Close()
+	<-errc
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+// relay copies messages from src to dst, noting each one.
+func (rc *recConn) relay(src, dst net.Conn) error {
+	rd := bufio.NewReader(src)
+	for {
+		msg, err := readMsg(rd)
+		if err != nil {
+			return err
+		}
+		if _, err := dst.Write(msg); err != nil {
+			return err
+		}
+		fc, err, _ := warp9.Unpack(msg)
+		if err != nil {
+			continue // not ours to judge; pass it on
+		}
+		rc.note(fc, msg, time.Now())
+	}
+}
+
+// readMsg reads one size-prefixed message.
+func readMsg(rd io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(rd, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint32(size[:])
+	if n < 7 || n > 16<<20 {
+		return nil, fmt.Errorf("record: bad message size %d", n)
+	}
+	msg := make([]byte, n)
+	copy(msg, size[:])
+	_, err := io.ReadFull(rd, msg[4:])
+	return msg, err
+}
+
+// note records a request, or writes the entry for a response.
+func (rc *recConn) note(fc *warp9.Fcall, msg []byte, now time.Time) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if (fc.Type-warp9.Tversion)%2 == 0 {
+		rc.pending[fc.Tag] = &pendingReq{fc, now}
+		return
+	}
+	req := rc.pending[fc.Tag]
+	if req == nil {
+		return
+	}
+	delete(rc.pending, fc.Tag)
+	tc := req.fc
+
+	e := &SessionEntry{
+		At:      Duration(req.at.Sub(rc.rec.start)),
+		Conn:    rc.id,
+		Path:    rc.fids[tc.Fid],
+		Latency: Duration(now.Sub(req.at)),
+	}
+	if fc.Type == warp9.Rerror {
+		e.Errno = int16(binary.LittleEndian.Uint16(msg[7:9]))
+		e.Error = warp9.Error(e.Errno).Error()
+	}
+	switch tc.Type {
+	case warp9.Tattach:
+		e.Op, e.Path = "attach", "."
+		if e.Errno == 0 {
+			rc.fids[tc.Fid] = "."
+		}
+	case warp9.Twalk:
+		e.Op = "walk"
+		e.Path = path.Join(append([]string{e.Path}, tc.Wname...)...)
+		if e.Path == ".." || strings.HasPrefix(e.Path, "../") {
+			e.Path = "." // walked above the root
+		}
+		if e.Errno == 0 {
+			rc.fids[tc.Newfid] = e.Path
+		}
+	case warp9.Topen:
+		e.Op, e.Mode = "open", tc.Mode
+	case warp9.Tread:
+		e.Op, e.Offset, e.Count = "read", tc.Offset, tc.Count
+		e.Data = fc.Data
+	case warp9.Twrite:
+		e.Op, e.Offset, e.Data = "write", tc.Offset, tc.Data
+		e.Count = fc.Count
+	case warp9.Tstat:
+		e.Op = "stat"
+		if e.Errno == 0 {
+			d := fc.Dir
+			e.Dir = &d
+		}
+	case warp9.Tclunk, warp9.Tremove:
+		delete(rc.fids, tc.Fid)
+		return
+	case warp9.Tflush:
+		delete(rc.pending, tc.Oldtag)
+		return
+	default:
+		return // version and auth
+	}
+
+	rc.rec.mu.Lock()
+	rc.rec.w.Encode(e)
+	rc.rec.mu.Unlock()
+}
+
+// LoadSession reads a session file written by a Recorder.
+func LoadSession(file string) ([]*SessionEntry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var session []*SessionEntry
+	dec := json.NewDecoder(f)
+	for {
+		e := new(SessionEntry)
+		if err := dec.Decode(e); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: entry %d: %v", file, len(session)+1, err)
+		}
+		session = append(session, e)
+	}
+	return session, nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package sensim
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lavaorg/warp/warp9"
+)
+
+// recordOne relays one connection made to the returned address on to
+// the device at dev. The session is sent on the channel once the
+// connection closes.
+func recordOne(t *testing.T, dev string) (string, <-chan []*SessionEntry) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	done := make(chan []*SessionEntry, 1)
+	go func() {
+		defer close(done)
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		up, err := net.Dial("tcp", dev)
+		if err != nil {
+			c.Close()
+			return
+		}
+		var buf bytes.Buffer
+		NewRecorder(&buf).Record(c, up)
+
+		file := filepath.Join(t.TempDir(), "session.json")
+		if err := os.WriteFile(file, buf.Bytes(), 0644); err != nil {
+			t.Error(err)
+			return
+		}
+		session, err := LoadSession(file)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- session
+	}()
+	return l.Addr().String(), done
+}
+
+// session runs a fixed exchange on c and returns the answers.
+func session(c *rawConn) []*warp9.Fcall {
+	var out []*warp9.Fcall
+	rpc := func(typ uint8, tag uint16, fields ...[]byte) {
+		c.send(typ, tag, fields...)
+		out = append(out, c.recv())
+	}
+	rpc(warp9.Twalk, 2, u32(0), u32(1), u16(1), str("ctl"))
+	rpc(warp9.Topen, 3, u32(1), []byte{warp9.ORDWR})
+	rpc(warp9.Twrite, 4, u32(1), u32(0), u32(0), u32(12), []byte("set-value 7\n"))
+	rpc(warp9.Tread, 5, u32(1), u32(0), u32(0), u32(100))
+	rpc(warp9.Twalk, 6, u32(0), u32(2), u16(1), str("sensors"))
+	rpc(warp9.Topen, 7, u32(2), []byte{warp9.OREAD})
+	rpc(warp9.Tread, 8, u32(2), u32(0), u32(0), u32(100))
+	rpc(warp9.Tstat, 9, u32(2))
+	rpc(warp9.Twalk, 10, u32(0), u32(3), u16(1), str("missing"))
+	return out
+}
+
+// A recorded session played back gives the recorded answers.
+func TestRecordReplay(t *testing.T) {
+	addr, done := recordOne(t, start(t, NewSenSrv("rec", 0)))
+	c := dial(t, addr)
+	live := session(c)
+	c.Close()
+	rec := <-done
+
+	var ops []string
+	for _, e := range rec {
+		ops = append(ops, e.Op)
+	}
+	want := []string{"attach", "walk", "open", "write", "read", "walk", "open", "read", "stat", "walk"}
+	if len(ops) != len(want) {
+		t.Fatalf("recorded %v, want %v", ops, want)
+	}
+	for i := range want {
+		if ops[i] != want[i] {
+			t.Fatalf("recorded %v, want %v", ops, want)
+		}
+	}
+	if e := rec[len(rec)-1]; e.Path != "missing" || e.Errno == 0 {
+		t.Errorf("failed walk recorded as %+v", e)
+	}
+
+	srv, err := NewReplaySrv("replay", rec, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = dial(t, start(t, srv))
+	replayed := session(c)
+	for i, fc := range replayed {
+		rc := live[i]
+		switch {
+		case fc == nil || rc == nil:
+			t.Fatalf("answer %d: recorded %v, replayed %v", i, rc, fc)
+		case fc.Type != rc.Type:
+			t.Errorf("answer %d: recorded type %d, replayed %d", i, rc.Type, fc.Type)
+		case fc.Type == warp9.Rread && !bytes.Equal(fc.Data, rc.Data):
+			t.Errorf("answer %d: recorded read %q, replayed %q", i, rc.Data, fc.Data)
+		case fc.Type == warp9.Rwrite && fc.Count != rc.Count:
+			t.Errorf("answer %d: recorded write of %d, replayed %d", i, rc.Count, fc.Count)
+		case fc.Type == warp9.Rstat && fc.Dir.Length != rc.Dir.Length:
+			t.Errorf("answer %d: recorded length %d, replayed %d", i, rc.Dir.Length, fc.Dir.Length)
+		}
+	}
+
+	// requests the session does not hold
+	c.send(warp9.Twrite, 11, u32(1), u32(100), u32(0), u32(4), []byte("nope"))
+	c.expect(warp9.Rerror, 11)
+	c.send(warp9.Tread, 12, u32(2), u32(1000), u32(0), u32(100))
+	if fc := c.expect(warp9.Rread, 12); len(fc.Data) != 0 {
+		t.Errorf("read past the recorded content: %q", fc.Data)
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package sensim
+
+import (
+	"errors"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lavaorg/warp/warp9"
+)
+
+// NewReplaySrv creates a device that plays back a recorded session
+// (see Recorder). Its tree holds every path the session reached.
+// Requests are matched to the recording by path: successive reads of
+// an object at an offset return the successive recorded reads at that
+// offset, starting over after the last, and opens, writes and stats
+// likewise get the recorded results. Opens, reads and writes take the
+// recorded latency; stats are answered at once, as directory reads
+// stat every entry.
+func NewReplaySrv(id string, session []*SessionEntry, debug int) (*SenSrv, error) {
+	srv := newSenSrv(id, debug)
+
+	items := make(map[string]*replayItem)
+	dirs := make(map[string]bool)
+	for _, e := range session {
+		p := path.Clean(e.Path)
+		if p == "." || e.Op == "walk" && e.Errno != 0 {
+			continue
+		}
+		it := items[p]
+		if it == nil {
+			it = &replayItem{ops: make(map[string][]*SessionEntry), next: make(map[string]int)}
+			items[p] = it
+		}
+		it.ops[e.Op] = append(it.ops[e.Op], e)
+		if e.Dir != nil {
+			it.dir = e.Dir
+		}
+		for d := path.Dir(p); d != "."; d = path.Dir(d) {
+			dirs[d] = true
+		}
+	}
+
+	paths := make([]string, 0, len(items))
+	for p, it := range items {
+		if it.dir != nil && it.dir.Mode&warp9.DMDIR != 0 {
+			dirs[p] = true
+		}
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		if dirs[p] {
+			if _, err := srv.Mkdir(p); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		it := items[p]
+		_, err := srv.addItem(p, func(sdir *SenDir) (*SenDir, error) {
+			switch {
+			case it.dir != nil:
+				sdir.Mode = it.dir.Mode &^ warp9.DMDIR
+			case len(it.ops["write"]) > 0:
+				sdir.Mode = uint32(perms(warp9.DMREAD|warp9.DMWRITE, warp9.DMREAD|warp9.DMWRITE, warp9.DMREAD))
+			}
+			sdir.item = it
+			return sdir, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return srv, nil
+}
+
+var errNotRecorded = errors.New("replay: request not in session")
+
+// replayItem answers for one recorded path.
+type replayItem struct {
+	sync.Mutex
+	dir  *warp9.Dir                 // latest recorded stat
+	ops  map[string][]*SessionEntry // by op, in recorded order
+	next map[string]int             // where the next match of an op is looked for
+}
+
+// match returns the next recorded op entry that ok accepts, looking
+// from the last match on and wrapping around, or nil.
+func (it *replayItem) match(op string, ok func(e *SessionEntry) bool) *SessionEntry {
+	it.Lock()
+	defer it.Unlock()
+	es := it.ops[op]
+	for i := range es {
+		j := (it.next[op] + i) % len(es)
+		if ok(es[j]) {
+			it.next[op] = j + 1
+			return es[j]
+		}
+	}
+	return nil
+}
+
+// answer waits out e's latency and returns its recorded error.
+func answer(e *SessionEntry) error {
+	time.Sleep(time.Duration(e.Latency))
+	if e.Errno != 0 {
+		return warp9.Error(e.Errno)
+	}
+	return nil
+}
+
+func anyEntry(e *SessionEntry) bool { return true }
+
+func (it *replayItem) Stat(dir *SenDir) error {
+	e := it.match("stat", anyEntry)
+	if e == nil {
+		return nil
+	}
+	if e.Errno != 0 {
+		return warp9.Error(e.Errno)
+	}
+	if e.Dir == nil {
+		return nil
+	}
+	dir.Length = e.Dir.Length
+	dir.Atime, dir.Mtime = e.Dir.Atime, e.Dir.Mtime
+	return nil
+}
+
+func (it *replayItem) Open(dir *SenDir, mode uint8) (Handle, error) {
+	e := it.match("open", func(e *SessionEntry) bool { return e.Mode == mode })
+	if e != nil {
+		if err := answer(e); err != nil {
+			return nil, err
+		}
+	}
+	return &replayHandle{it}, nil
+}
+
+// replayHandle is an open replayItem; replays are shared by all fids.
+type replayHandle struct {
+	it *replayItem
+}
+
+func (h *replayHandle) ReadAt(off uint64, count uint32) ([]byte, error) {
+	e := h.it.match("read", func(e *SessionEntry) bool { return e.Offset == off })
+	if e == nil {
+		if off > 0 {
+			return nil, nil // past the recorded content
+		}
+		return nil, errNotRecorded
+	}
+	if err := answer(e); err != nil {
+		return nil, err
+	}
+	return window(e.Data, 0, count), nil
+}
+
+// WriteAt matches a recorded write of the same data, else the next
+// one at the offset.
+func (h *replayHandle) WriteAt(data []byte, off uint64) (uint32, error) {
+	e := h.it.match("write", func(e *SessionEntry) bool { return e.Offset == off && string(e.Data) == string(data) })
+	if e == nil {
+		e = h.it.match("write", func(e *SessionEntry) bool { return e.Offset == off })
+	}
+	if e == nil {
+		return 0, errNotRecorded
+	}
+	if err := answer(e); err != nil {
+		return 0, err
+	}
+	return e.Count, nil
+}
+
+func (h *replayHandle) Clunk() {}
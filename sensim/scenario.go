@@ -0,0 +1,361 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package sensim
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Scenario describes a simulated device fleet: the devices, their
+// object trees and sensor models, when they connect to the collector
+// and the events that happen to them. Scenarios are JSON files, e.g.
+//
+//	{
+//	  "seed": 7,
+//	  "collector": "127.0.0.1:9901",
+//	  "key": "s3cret",
+//	  "devices": [{
+//	    "name": "thermo", "count": 10,
+//	    "info": {"model": "thermo-2", "firmware": "2.1.0"},
+//	    "dirs": ["zones"],
+//	    "actuators": [{"path": "heater", "kind": "setpoint", "min": 5, "max": 30, "initial": 18, "delay": "30s"}],
+//	    "sensors": [{"path": "sensors", "interval": "1s", "unit": "C", "encoding": "json",
+//	                 "model": {"type": "diurnal", "min": 12, "max": 28, "peak": "14h"}}],
+//	    "faults": [{"kind": "delay", "op": "read", "delay": "2s", "prob": 0.1}],
+//	    "schedule": {"start": "2s", "sessions": 100, "every": "10s"},
+//	    "events": [{"at": "5m", "action": "ctl", "command": "set-value 99"},
+//	               {"at": "8m", "action": "ctl", "command": "fault hang path=sensors"},
+//	               {"at": "10m", "action": "offline"}]
+//	  }]
+//	}
+//
+// Models without a seed get one derived from the scenario seed and
+// the device's position in the fleet, so every run is the same; the
+// same seed drives probabilistic faults. Devices with a key only
+// serve collectors that authenticate with it (see SetAuthKey).
+type Scenario struct {
+	Seed      int64        `json:"seed"`
+	Collector string       `json:"collector"` // address devices dial; cmd/sensim defaults it to -a
+	Key       string       `json:"key"`       // pre-shared auth key of every device
+	Devices   []DeviceSpec `json:"devices"`
+}
+
+// DeviceSpec describes Count identical devices.
+type DeviceSpec struct {
+	Name      string         `json:"name"`
+	Count     int            `json:"count"` // default 1
+	Dirs      []string       `json:"dirs"`
+	Actuators []ActuatorSpec `json:"actuators"` // made before the sensors
+	Sensors   []SensorSpec   `json:"sensors"`
+	Info      *Identity      `json:"info"` // unset fields are generated
+	Faults    []Fault        `json:"faults"`
+	Schedule  Schedule       `json:"schedule"`
+	Events    []Event        `json:"events"`
+	Key       *string        `json:"key"` // overrides the scenario key; "" for none
+}
+
+// SensorSpec places a sensor in the tree. Naming an existing sensor
+// (e.g. the default "sensors") reconfigures it. Encoding is one of
+// the reading encodings (see Reading).
+type SensorSpec struct {
+	Path     string     `json:"path"`
+	Model    *ModelSpec `json:"model"`
+	Interval Duration   `json:"interval"`
+	Unit     string     `json:"unit"`
+	Encoding string     `json:"encoding"`
+	History  int        `json:"history"`   // readings kept; 0 is the default
+	NextWait Duration   `json:"next_wait"` // see nextItem; 0 is the default
+}
+
+// Schedule is when a device connects to the collector.
+type Schedule struct {
+	Start    Duration `json:"start"`    // delay before the first connection
+	Sessions int      `json:"sessions"` // connections to make; default 1
+	Every    Duration `json:"every"`    // pause after each session
+}
+
+// Event happens to a device At a time since the scenario started:
+//
+//	ctl        -- run Command as if written to the ctl object
+//	disconnect -- drop the current connection
+//	offline    -- drop the connection and never reconnect
+type Event struct {
+	At      Duration `json:"at"`
+	Action  string   `json:"action"`
+	Command string   `json:"command"`
+}
+
+// RunStats summarizes a scenario run.
+type RunStats struct {
+	Devices     int64
+	Sessions    int64 // connections served to completion
+	DialErrors  int64
+	Disconnects int64 // connections dropped by events
+	Offline     int64 // devices gone offline for good
+}
+
+func (st *RunStats) String() string {
+	return fmt.Sprintf("devices:%d sessions:%d dial-errors:%d disconnects:%d offline:%d",
+		st.Devices, st.Sessions, st.DialErrors, st.Disconnects, st.Offline)
+}
+
+// LoadScenario reads a JSON scenario file.
+func LoadScenario(file string) (*Scenario, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	sc := new(Scenario)
+	if err = json.Unmarshal(b, sc); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return sc, sc.check()
+}
+
+func (sc *Scenario) check() error {
+	for _, d := range sc.Devices {
+		for _, ev := range d.Events {
+			switch ev.Action {
+			case "ctl", "disconnect", "offline":
+			default:
+				return fmt.Errorf("scenario: device %s: unknown event %q", d.Name, ev.Action)
+			}
+		}
+		for _, f := range d.Faults {
+			if err := f.check(); err != nil {
+				return fmt.Errorf("scenario: device %s: %v", d.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// device is one running instance of a DeviceSpec.
+type device struct {
+	srv   *SenSrv
+	spec  *DeviceSpec
+	stats *RunStats
+
+	mu      sync.Mutex
+	conn    net.Conn
+	offline bool
+	stop    chan struct{} // closed when the device goes offline
+}
+
+// Run builds every device and runs their schedules, returning when
+// all devices are done.
+func (sc *Scenario) Run(debug int) (*RunStats, error) {
+	if sc.Collector == "" {
+		return nil, errors.New("scenario: no collector address")
+	}
+	stats := new(RunStats)
+	var devs []*device
+	n := int64(0)
+	for i := range sc.Devices {
+		spec := &sc.Devices[i]
+		count := spec.Count
+		if count == 0 {
+			count = 1
+		}
+		for j := 0; j < count; j++ {
+			n++
+			srv, err := spec.build(fmt.Sprintf("%s%d", spec.Name, j), sc.Seed*1000003+n, debug)
+			if err != nil {
+				return nil, err
+			}
+			key := sc.Key
+			if spec.Key != nil {
+				key = *spec.Key
+			}
+			if key != "" {
+				srv.SetAuthKey([]byte(key))
+			}
+			devs = append(devs, &device{srv: srv, spec: spec, stats: stats, stop: make(chan struct{})})
+		}
+	}
+	stats.Devices = int64(len(devs))
+
+	var timers []*time.Timer
+	var wg sync.WaitGroup
+	wg.Add(len(devs))
+	for _, d := range devs {
+		d := d
+		for _, ev := range d.spec.Events {
+			ev := ev
+			timers = append(timers, time.AfterFunc(time.Duration(ev.At), func() { d.event(&ev) }))
+		}
+		go d.run(sc.Collector, &wg)
+	}
+	wg.Wait()
+
+	for _, t := range timers {
+		t.Stop()
+	}
+	return stats, nil
+}
+
+// build creates one device instance.
+func (spec *DeviceSpec) build(id string, seed int64, debug int) (*SenSrv, error) {
+	srv := NewSenSrv(id, debug)
+	ident := NewIdentity(seed)
+	if spec.Info != nil {
+		info := *spec.Info
+		if spec.Count > 1 {
+			// every device has its own
+			info.Serial, info.ID = "", ""
+		}
+		info.merge(ident)
+		ident = &info
+	}
+	srv.SetIdentity(ident)
+	for _, dir := range spec.Dirs {
+		if _, err := srv.Mkdir(dir); err != nil {
+			return nil, fmt.Errorf("%s: %v", id, err)
+		}
+	}
+	for i := range spec.Actuators {
+		if err := srv.AddActuator(&spec.Actuators[i]); err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", id, spec.Actuators[i].Path, err)
+		}
+	}
+	for _, s := range spec.Sensors {
+		m := s.Model
+		if m != nil {
+			m = m.withSeed(seed)
+		}
+		sensor, err := srv.configureSensor(s.Path, m, time.Duration(s.Interval))
+		if err == nil && s.Encoding != "" {
+			err = sensor.setEncoding(s.Encoding)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", id, s.Path, err)
+		}
+		sensor.setUnit(s.Unit)
+		if s.History > 0 {
+			sensor.setHistory(s.History)
+		}
+		if s.NextWait > 0 {
+			sensor.setNextWait(time.Duration(s.NextWait))
+		}
+	}
+	srv.SeedFaults(seed)
+	for _, f := range spec.Faults {
+		f := f
+		if err := srv.AddFault(&f); err != nil {
+			return nil, fmt.Errorf("%s: fault: %v", id, err)
+		}
+	}
+	srv.Start(srv)
+	return srv, nil
+}
+
+// withSeed returns a copy of spec with seed filled in where unset.
+func (spec *ModelSpec) withSeed(seed int64) *ModelSpec {
+	m := *spec
+	if m.Seed == 0 {
+		m.Seed = seed
+	}
+	if m.Base != nil {
+		m.Base = m.Base.withSeed(seed + 1)
+	}
+	return &m
+}
+
+func (d *device) run(collector string, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	sched := &d.spec.Schedule
+	sessions := sched.Sessions
+	if sessions == 0 {
+		sessions = 1
+	}
+	if !d.sleep(time.Duration(sched.Start)) {
+		return
+	}
+	for i := 0; i < sessions; i++ {
+		// wait out a reboot
+		select {
+		case <-d.srv.Up():
+		case <-d.stop:
+			return
+		}
+		addr := collector
+		if a := d.srv.ReportAddr(); a != "" {
+			addr = a
+		}
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			atomic.AddInt64(&d.stats.DialErrors, 1)
+			if d.srv.Debuglevel > 0 {
+				log.Printf("%s: dial: %v\n", d.srv.Id, err)
+			}
+		} else if d.setConn(c) {
+			d.srv.Serve(c)
+			d.setConn(nil)
+			atomic.AddInt64(&d.stats.Sessions, 1)
+		}
+		if !d.sleep(time.Duration(sched.Every)) {
+			return
+		}
+	}
+}
+
+// sleep waits for dur; false if the device went offline meanwhile.
+func (d *device) sleep(dur time.Duration) bool {
+	select {
+	case <-d.stop:
+		return false
+	case <-time.After(dur):
+		return true
+	}
+}
+
+// setConn records the current connection; false if offline.
+func (d *device) setConn(c net.Conn) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if c != nil && d.offline {
+		c.Close()
+		return false
+	}
+	d.conn = c
+	return true
+}
+
+func (d *device) dropConn() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn != nil {
+		d.conn.Close()
+		atomic.AddInt64(&d.stats.Disconnects, 1)
+	}
+}
+
+func (d *device) event(ev *Event) {
+	switch ev.Action {
+	case "ctl":
+		if _, err := d.srv.Command(ev.Command); err != nil {
+			log.Printf("%s: event ctl %q: %v\n", d.srv.Id, ev.Command, err)
+		}
+	case "disconnect":
+		d.dropConn()
+	case "offline":
+		d.dropConn()
+		d.mu.Lock()
+		if !d.offline {
+			d.offline = true
+			close(d.stop)
+			atomic.AddInt64(&d.stats.Offline, 1)
+		}
+		d.mu.Unlock()
+	}
+}
@@ -1,24 +1,65 @@
 // Copyright 2018 Larry Rau. All rights reserved
 // See Apache2 LICENSE
 
-// sensim provides a simple single level object server.
-// The root directory will have no directory objects; only entry objects.
+// sensim provides a simple object server simulating a sensor device.
+// Each SenSrv is an independent device with its own object tree.
+// Each device describes itself in an info directory (see Identity)
+// and accepts firmware updates through its firmware object.
+// Further sensors and directories can be added anywhere in the tree
+// with AddSensor and Mkdir (e.g. "sensors/temp1", "info/fw").
+// A sensor's readings follow a signal Model; AddSensorModel selects one
+// of the built in models (sine, diurnal, random walk, noise, steps,
+// stuck-at and drift faults, CSV replay).
+// Sensors serve timestamped, sequenced Readings in several encodings
+// and keep a history of recent ones for backfill; reads of a sensor's
+// next object block until a new reading is taken. Actuators (relays,
+// dimmers, setpoints) accept writes and can drive sensor models.
+// Every entry's content is an Object, opened per fid into a Handle;
+// simple read-only content can be written as an Item instead.
+// Traffic statistics are served by the stats object.
+// A Recorder captures the sessions of a real device, which
+// NewReplaySrv plays back as a simulated one.
+// A whole fleet of devices can be described by a Scenario file.
 //
-// The two objects provider are:
+// The two objects provided at the root are:
 //    ctl -- a control file
 //    sensors -- a read only file to serve sensor readings
 //
 // The simulator will periodically update the values of 'sensors'
+// Each sensor samples its model once per sample interval of the device
+// Clock; readers see the latest sample. Tests can install a VirtualClock
+// and fast-forward it (see also the ctl advance command).
 // If the ctl file is read without previously writing a commmand a simple
 // info message is returned.
 // if the ctl file is open rdwr and a valid command is writen the results
 // of the command can be immediately read. If multiple commands are writen
 // the result of each command can be read with line breaks in between.
+// A failing command fails the write and leaves an "error: <msg>" line
+// in place of its result; the commands after it are not run.
+// Results are kept per open fid. The commands are:
+//    status                      -- current value, sample interval, report address and traffic totals
+//    set-interval <dur>          -- sensor sample interval (e.g. 500ms)
+//    set-value <val>             -- force the sensor value
+//    reset                       -- restore the sensor's initial state
+//    set-unit <unit> [path]      -- unit reported with readings
+//    set-format <enc> [path]     -- reading encoding: value, text, json, cbor
+//    set-history <n> [path]      -- readings kept in the sensor's history
+//    set-next-wait <dur> [path]  -- longest a read of <sensor>.next blocks
+//    advance <dur>               -- fast-forward the device clock
+//    ip:<addr>                   -- address the device should report to
+//    actuators                   -- state of every actuator
+//    fw-install <sha256> <ver>   -- install the image written to firmware, reboot
+//    fw-reset                    -- discard the image written to firmware
+//    fw-fail <stage>             -- fail updates at upload, verify, apply, boot (or none)
+//    fw-reboot <dur>             -- how long a reboot takes
+//    fault <kind> ...            -- inject a fault (see Fault); fault list, fault clear
 //
 package sensim
 
 import (
 	"log"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/lavaorg/lrt/mlog"
@@ -26,40 +67,102 @@ import (
 )
 
 type senFid struct {
+	sync.Mutex
 	entry       *SenDir
-	direntrybuf []byte
+	direntrybuf []byte // packed listing, built when read at offset 0
+	direntends  []int  // end offset of each entry in direntrybuf
+	handle      Handle // the entry's object, once opened
 }
 
+// SenSrv is one simulated device. Each instance owns its object tree
+// and sensor state; create instances with NewSenSrv.
 type SenSrv struct {
 	warp9.Srv
 	warp9.StatsOps
+
+	mu     sync.Mutex // guards the tree shape, qidp, report and key
+	root   *SenDir
+	clock  Clock
+	qidp   uint64 //unique qid-path counter
+	report string // address set by the ctl "ip:" command
+	ident  Identity
+	boot   time.Time     // on the device clock
+	up     chan struct{} // closed while the device is up
+	key    []byte        // pre-shared auth key; nil needs no auth
+	stats  stats
+	faults faults
+
+	blockmu sync.Mutex
+	blocked map[*warp9.SrvReq]chan struct{} // reads of WaitHandles; nil if hung
+	flushed map[*warp9.SrvReq]struct{}      // flushed before they blocked
 }
 
 // SenDir represents an entry in the SenSim object server.
+// Directory entries hold their children by name.
 type SenDir struct {
 	warp9.Dir
-	item Item
+	item     content // an Item or Object; nil for directories
+	parent   *SenDir
+	children map[string]*SenDir
 }
 
+// Item is the simplest content of an object: generated, read-only
+// bytes. Items that need more implement Object instead. Unless an
+// item is a LiveItem reporting Live, a fid reads a snapshot: the
+// content is captured when the fid is opened and again on each later
+// read at offset 0, and reads at other offsets are served from that
+// copy, so a reading split over several reads is never a mix of
+// samples.
 type Item interface {
 	Stat(dir *SenDir) error
 	Read() ([]byte, error)
 }
 
-var root *SenDir = newSenDir(".", true)
+// LiveItem is implemented by items that may be read live.
+type LiveItem interface {
+	Item
+	Live() bool // Read on every request, without snapshots
+}
 
-var objects map[string]*SenDir //all our objects
-var qidp uint64 = uint64(0xF0) //unique qid-path counter
+// live reports whether it is read live.
+func live(it Item) bool {
+	l, ok := it.(LiveItem)
+	return ok && l.Live()
+}
 
-func init() {
-	objects = make(map[string]*SenDir)
-	objects[root.Name] = root
+// NewSenSrv creates a simulated device with its own object tree.
+// The caller starts it with srv.Start(srv).
+func NewSenSrv(id string, debug int) *SenSrv {
+	srv := newSenSrv(id, debug)
+	srv.addItem("ctl", newCtlItem(srv))
+	srv.addItem("sensors", srv.sensorMaker(nil))
+	srv.addItem("firmware", newFirmwareItem(srv))
+	srv.addItem("stats", func(sdir *SenDir) (*SenDir, error) {
+		sdir.item = &statsItem{srv}
+		return sdir, nil
+	})
+	srv.addInfo()
+	return srv
+}
 
-	objects["ctl"], _ = newSensorItem(newSenDir("ctl", false))
-	objects["sensors"], _ = newSensorItem(newSenDir("sensors", false))
+// newSenSrv creates a device with an empty tree.
+func newSenSrv(id string, debug int) *SenSrv {
+	srv := new(SenSrv)
+	srv.Id = id
+	srv.Debuglevel = debug
+	srv.qidp = uint64(0xF0)
+	srv.clock = new(WallClock)
+	srv.boot = srv.clock.Now()
+	srv.ident = *NewIdentity(idSeed(id))
+	srv.up = make(chan struct{})
+	close(srv.up)
+
+	srv.root = srv.newSenDir(".", true)
+	srv.root.parent = srv.root
+	return srv
 }
 
-func newSenDir(n string, dir bool) *SenDir {
+func (srv *SenSrv) newSenDir(n string, dir bool) *SenDir {
 	var d SenDir
 
 	d.Name = n
@@ -67,7 +170,7 @@ func newSenDir(n string, dir bool) *SenDir {
 	d.Gid = 20
 	d.Muid = 501
 
-	if n == "/" {
+	if dir {
 		d.Mode = warp9.DMDIR | uint32(perms(warp9.DMREAD, warp9.DMREAD, warp9.DMREAD))
 	} else {
 		d.Mode = uint32(perms(warp9.DMREAD, warp9.DMREAD, warp9.DMREAD))
@@ -75,13 +178,18 @@ func newSenDir(n string, dir bool) *SenDir {
 
 	d.Atime = uint32(time.Now().Unix())
 	d.Mtime = d.Atime
+	if dir {
+		d.children = make(map[string]*SenDir)
+	}
 
 	typ := uint8(warp9.QTOBJ)
 	if dir {
 		typ = warp9.QTDIR
 	}
-	d.Qid = warp9.Qid{typ, 0, qidp}
-	qidp++
+	srv.mu.Lock()
+	d.Qid = warp9.Qid{typ, 0, srv.qidp}
+	srv.qidp++
+	srv.mu.Unlock()
 
 	mlog.Debug("new SenDir:%v", d)
 	return &d
@@ -91,49 +199,147 @@ func perms(u, g, o byte) uint16 {
 	return uint16(uint16(u)<<6 | uint16(g)<<3 | uint16(o))
 }
 
-func (*SenSrv) ConnOpened(conn *warp9.Conn) {
+// ReportAddr returns the address the device was told to report to
+// via ctl, or "" if none was set.
+func (srv *SenSrv) ReportAddr() string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.report
+}
+
+func (srv *SenSrv) SetReportAddr(addr string) {
+	srv.mu.Lock()
+	srv.report = addr
+	srv.mu.Unlock()
+}
+
+func (srv *SenSrv) ConnOpened(conn *warp9.Conn) {
 	if conn.Srv.Debuglevel > 0 {
 		log.Println("connected")
 	}
+	srv.stats.opened(conn)
 }
 
-func (*SenSrv) ConnClosed(conn *warp9.Conn) {
+func (srv *SenSrv) ConnClosed(conn *warp9.Conn) {
 	if conn.Srv.Debuglevel > 0 {
 		log.Println("disconnected")
 	}
+	srv.stats.closedConn(conn)
+	// nobody is left to answer
+	srv.blockmu.Lock()
+	for req, cancel := range srv.blocked {
+		if req.Conn == conn {
+			delete(srv.blocked, req)
+			if cancel != nil {
+				close(cancel)
+			}
+		}
+	}
+	for req := range srv.flushed {
+		if req.Conn == conn {
+			delete(srv.flushed, req)
+		}
+	}
+	srv.blockmu.Unlock()
 }
 
 func (*SenSrv) FidDestroy(sfid *warp9.SrvFid) {
-	var fid *senFid
-
-	if sfid.Aux == nil {
-		return
+	fid, ok := sfid.Aux.(*senFid)
+	if !ok {
+		return // unattached, or an afid
 	}
 
-	fid = sfid.Aux.(*senFid)
 	if sfid.Fconn.Debuglevel > 0 {
 		log.Printf("fid destroy:%v\n", fid)
 	}
-	//cleanup fid
+	fid.clunk()
+}
+
+// clunk closes the fid's handle, if any.
+func (fid *senFid) clunk() {
+	fid.Lock()
+	h := fid.handle
+	fid.handle = nil
+	fid.Unlock()
+	if h != nil {
+		h.Clunk()
+	}
 }
 
+// open opens the fid's entry, replacing any earlier handle.
+func (fid *senFid) open(mode uint8) (Handle, error) {
+	obj := fid.entry.object()
+	if obj == nil {
+		return nil, warp9.Error(warp9.Ebaduse)
+	}
+	h, err := obj.Open(fid.entry, mode)
+	if err != nil {
+		return nil, err
+	}
+	fid.clunk()
+	fid.Lock()
+	fid.handle = h
+	fid.Unlock()
+	return h, nil
+}
+
+// opened returns the fid's handle, opening the entry with mode if
+// the client did not.
+func (fid *senFid) opened(mode uint8) (Handle, error) {
+	fid.Lock()
+	h := fid.handle
+	fid.Unlock()
+	if h != nil {
+		return h, nil
+	}
+	return fid.open(mode)
+}
+
+// writable reports whether the entry allows the open mode.
+func writable(d *SenDir, mode uint8) bool {
+	mode &= 3
+	return (mode != warp9.OWRITE && mode != warp9.ORDWR) || d.Mode&(warp9.DMWRITE<<6) != 0
+}
+
+// Attach is only reached once AuthCheck has passed.
 func (ufs *SenSrv) Attach(req *warp9.SrvReq) {
-	if req.Afid != nil {
-		req.RespondError(warp9.Error(warp9.Enoauth))
+	if ufs.inject(req, ufs.fault("attach", ufs.root)) {
 		return
 	}
 	//tc := req.Tc
 	// ignore the aname; just mount "/"
 	fid := new(senFid)
-	fid.entry = root
+	fid.entry = ufs.root
 	req.Fid.Aux = fid
-	req.RespondRattach(&root.Qid)
+	req.RespondRattach(&ufs.root.Qid)
 }
 
-func (*SenSrv) Flush(req *warp9.SrvReq) {}
+// Flush cancels a read blocked on a next object. A request hung by
+// a fault fails, so that the client sees an answer before Rflush.
+// A request still being served is cancelled if it goes on to block.
+func (srv *SenSrv) Flush(req *warp9.SrvReq) {
+	srv.blockmu.Lock()
+	cancel, ok := srv.blocked[req]
+	delete(srv.blocked, req)
+	if !ok {
+		if srv.flushed == nil {
+			srv.flushed = make(map[*warp9.SrvReq]struct{})
+		}
+		srv.flushed[req] = struct{}{}
+	}
+	srv.blockmu.Unlock()
+	switch {
+	case !ok:
+	case cancel == nil:
+		req.RespondError(warp9.Error(warp9.Eio))
+	default:
+		close(cancel)
+		req.Flush()
+	}
+}
 
-func (*SenSrv) Walk(req *warp9.SrvReq) {
-	fid := req.Fid.Aux.(*senFid)
+func (srv *SenSrv) Walk(req *warp9.SrvReq) {
+	fid, _ := req.Fid.Aux.(*senFid) // nil for an afid
 	tc := req.Tc
 	if fid == nil {
 		req.RespondError(warp9.Error(warp9.Ebaduse))
@@ -144,17 +350,22 @@ func (*SenSrv) Walk(req *warp9.SrvReq) {
 		req.Newfid.Aux = new(senFid)
 	}
 
-	p := "."
-	if len(tc.Wname) > 0 {
-		p = tc.Wname[0]
-		if p == "." || p == ".." {
-			p = "."
+	// Rwalk carries only the qid of the final element; every
+	// element must exist for the walk to succeed.
+	o := fid.entry
+	for _, name := range tc.Wname {
+		next := srv.walk1(o, name)
+		if next == nil {
+			next = srv.view(o, name)
+		}
+		o = next
+		if o == nil {
+			req.RespondError(warp9.Error(warp9.Enotexist))
+			log.Printf("obj not found: %v\n", name)
+			return
 		}
 	}
-	o := objects[p]
-	if o == nil {
-		req.RespondError(warp9.Error(warp9.Enotexist))
-		log.Printf("obj not found: %v\n", p)
+	if srv.inject(req, srv.fault("walk", o)) {
 		return
 	}
 	senfid := req.Newfid.Aux.(*senFid)
@@ -163,15 +374,28 @@ func (*SenSrv) Walk(req *warp9.SrvReq) {
 	req.RespondRwalk(&senfid.entry.Qid)
 }
 
-func (*SenSrv) Open(req *warp9.SrvReq) {
+func (srv *SenSrv) Open(req *warp9.SrvReq) {
 
 	tc := req.Tc
-	mode := tc.Mode
-	if mode != warp9.OREAD {
+	mode := tc.Mode & 3
+	sfid, _ := req.Fid.Aux.(*senFid)
+	if sfid == nil {
+		req.RespondError(warp9.Error(warp9.Ebaduse))
+		return
+	}
+	if srv.inject(req, srv.fault("open", sfid.entry)) {
+		return
+	}
+	if !writable(sfid.entry, mode) {
 		req.RespondError(warp9.Error(warp9.Eperm))
 		return
 	}
-	sfid := req.Fid.Aux.(*senFid)
+	if sfid.entry.Mode&warp9.DMDIR == 0 {
+		if _, err := sfid.open(tc.Mode); err != nil {
+			req.RespondError(werror(err, warp9.Eio))
+			return
+		}
+	}
 	req.RespondRopen(&sfid.entry.Qid, 0)
 }
 
@@ -180,88 +404,196 @@ func (*SenSrv) Create(req *warp9.SrvReq) {
 	req.RespondError(warp9.Error(warp9.Enotimpl))
 }
 
-func (*SenSrv) Read(req *warp9.SrvReq) {
+func (srv *SenSrv) Read(req *warp9.SrvReq) {
 	tc := req.Tc
 	fid := req.Fid
+	sfid := fid.Aux.(*senFid)
+
+	f := srv.fault("read", sfid.entry)
+	if srv.inject(req, f) {
+		return
+	}
 
 	rc := req.Rc
 	rc.InitRread(tc.Count)
 
-	// should check for having been opened
-
-	// convert our directory to byte buffer; we aren't caching
-	//b := warp9.PackDir(&root.Dir, req.Conn.Dotu)
 	var b []byte
 	var err *warp9.WarpError
 	if fid.Type&warp9.QTDIR > 0 {
-		b, err = readdir(req)
+		b, err = srv.readdir(req)
 	} else {
-		b, err = readobj(req)
+		h, e := sfid.opened(warp9.OREAD)
+		if e != nil {
+			req.RespondError(werror(e, warp9.Eio))
+			return
+		}
+		if wh, ok := h.(WaitHandle); ok {
+			srv.readWait(req, wh)
+			return
+		}
+		if b, e = h.ReadAt(tc.Offset, tc.Count); e != nil {
+			err = werror(e, warp9.Eio)
+		}
 	}
 	if err != nil {
 		req.RespondError(err)
 		return
 	}
 
-	// determine which and how many bytes to return
-	var count int
-	switch {
-	case tc.Offset > uint64(len(b)):
-		count = 0
-	case len(b[tc.Offset:]) > int(tc.Count):
-		count = int(tc.Count)
-	default:
-		count = len(b[tc.Offset:])
+	count := copy(rc.Data, b)
+	if f != nil && f.Kind == "corrupt" {
+		srv.corrupt(rc.Data[:count])
 	}
-	copy(rc.Data, b[tc.Offset:int(tc.Offset)+count])
 	log.Printf("buf:%v, rc.Data: %v, off:%v,  count:%v\n", len(b), len(rc.Data), tc.Offset, count)
 	rc.SetRreadCount(uint32(count))
 	req.Respond()
 }
 
-func readdir(req *warp9.SrvReq) ([]byte, *warp9.WarpError) {
-	buf := make([]byte, 100)
-	for _, o := range objects {
-		b := warp9.PackDir(&o.Dir)
-		buf = append(buf, b...)
+// block registers req as blocked; Flush closes cancel (nil for a
+// hung request). It reports false if req was flushed already.
+func (srv *SenSrv) block(req *warp9.SrvReq, cancel chan struct{}) bool {
+	srv.blockmu.Lock()
+	defer srv.blockmu.Unlock()
+	if _, ok := srv.flushed[req]; ok {
+		delete(srv.flushed, req)
+		return false
 	}
-	return buf, nil
+	if srv.blocked == nil {
+		srv.blocked = make(map[*warp9.SrvReq]chan struct{})
+	}
+	srv.blocked[req] = cancel
+	return true
 }
 
-func readobj(req *warp9.SrvReq) ([]byte, *warp9.WarpError) {
-	sfid := req.Fid.Aux.(*senFid)
-	sdir := sfid.entry
+// answered forgets any early flush of req.
+func (srv *SenSrv) answered(req *warp9.SrvReq) {
+	srv.blockmu.Lock()
+	delete(srv.flushed, req)
+	srv.blockmu.Unlock()
+}
 
-	if sdir.item != nil {
-		b, e := sdir.item.Read()
-		if e != nil {
-			return nil, warp9.Error(warp9.Eio)
+// readWait answers a read that may block, unless the read is flushed
+// (or its connection closed) first.
+func (srv *SenSrv) readWait(req *warp9.SrvReq, h WaitHandle) {
+	cancel := make(chan struct{})
+	if !srv.block(req, cancel) {
+		req.Flush()
+		return
+	}
+
+	b, err := h.ReadWait(req.Tc.Offset, req.Tc.Count, cancel)
+
+	srv.blockmu.Lock()
+	_, waiting := srv.blocked[req]
+	delete(srv.blocked, req)
+	srv.blockmu.Unlock()
+	if !waiting {
+		return // flushed
+	}
+	if err != nil {
+		req.RespondError(werror(err, warp9.Eio))
+		return
+	}
+	req.RespondRread(b)
+}
+
+// readdir returns the whole entries, sorted by name, that fit in the
+// read. The listing is taken when the fid is read at offset 0 and
+// later offsets continue in that listing, so a fid sees a consistent
+// directory until it starts over.
+func (srv *SenSrv) readdir(req *warp9.SrvReq) ([]byte, *warp9.WarpError) {
+	tc := req.Tc
+	sfid := req.Fid.Aux.(*senFid)
+	sfid.Lock()
+	defer sfid.Unlock()
+
+	if tc.Offset == 0 || sfid.direntends == nil {
+		kids := srv.children(sfid.entry)
+		sort.Slice(kids, func(i, j int) bool { return kids[i].Name < kids[j].Name })
+		sfid.direntrybuf = nil
+		sfid.direntends = make([]int, 0, len(kids))
+		for _, o := range kids {
+			d, err := o.stat()
+			if err != nil {
+				d = &o.Dir
+			}
+			sfid.direntrybuf = append(sfid.direntrybuf, warp9.PackDir(d)...)
+			sfid.direntends = append(sfid.direntends, len(sfid.direntrybuf))
 		}
-		return b, nil
 	}
-	return nil, warp9.Error(warp9.Eio)
+
+	off := int(tc.Offset)
+	if tc.Offset >= uint64(len(sfid.direntrybuf)) {
+		return nil, nil
+	}
+	// the offset must be where an entry starts
+	i := sort.SearchInts(sfid.direntends, off)
+	if off != 0 && (i == len(sfid.direntends) || sfid.direntends[i] != off) {
+		return nil, warp9.Error(warp9.Ebadoffset)
+	}
+	if off != 0 {
+		i++
+	}
+	end := off
+	for ; i < len(sfid.direntends) && sfid.direntends[i]-off <= int(tc.Count); i++ {
+		end = sfid.direntends[i]
+	}
+	if end == off {
+		return nil, warp9.Error(warp9.Ebufsmall)
+	}
+	return sfid.direntrybuf[off:end], nil
 }
 
-func (*SenSrv) Write(req *warp9.SrvReq) {
-	req.RespondError(warp9.Error(warp9.Enotimpl))
-	return
+func (srv *SenSrv) Write(req *warp9.SrvReq) {
+	tc := req.Tc
+	sfid := req.Fid.Aux.(*senFid)
+	if srv.inject(req, srv.fault("write", sfid.entry)) {
+		return
+	}
+	if sfid.entry.Mode&warp9.DMDIR != 0 || !writable(sfid.entry, warp9.OWRITE) {
+		req.RespondError(warp9.Error(warp9.Eperm))
+		return
+	}
+	h, err := sfid.opened(warp9.OWRITE)
+	if err != nil {
+		req.RespondError(werror(err, warp9.Eio))
+		return
+	}
+	n, err := h.WriteAt(tc.Data, tc.Offset)
+	if err != nil {
+		log.Printf("%s: %v\n", sfid.entry.Name, err)
+		req.RespondError(werror(err, warp9.Einval))
+		return
+	}
+	req.RespondRwrite(n)
 }
 
-func (*SenSrv) Clunk(req *warp9.SrvReq) { req.RespondRclunk() }
+func (*SenSrv) Clunk(req *warp9.SrvReq) {
+	req.Fid.Aux.(*senFid).clunk()
+	req.RespondRclunk()
+}
 
 func (*SenSrv) Remove(req *warp9.SrvReq) {
 	req.RespondError(warp9.Error(warp9.Enotimpl))
 	return
 }
 
-func (*SenSrv) Stat(req *warp9.SrvReq) {
+func (srv *SenSrv) Stat(req *warp9.SrvReq) {
 	mlog.Debug("Stat: %v", req)
-	fid := req.Fid.Aux.(*senFid)
-	sdir := fid.entry
-	if sdir.item != nil {
-		sdir.item.Stat(sdir)
+	fid, _ := req.Fid.Aux.(*senFid)
+	if fid == nil {
+		req.RespondError(warp9.Error(warp9.Ebaduse))
+		return
+	}
+	if srv.inject(req, srv.fault("stat", fid.entry)) {
+		return
+	}
+	d, err := fid.entry.stat()
+	if err != nil {
+		req.RespondError(werror(err, warp9.Eio))
+		return
 	}
-	req.RespondRstat(&fid.entry.Dir)
+	req.RespondRstat(d)
 	return
 }
 func (u *SenSrv) Wstat(req *warp9.SrvReq) {
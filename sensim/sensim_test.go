@@ -0,0 +1,165 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package sensim
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lavaorg/warp/warp9"
+)
+
+// start serves srv on a loopback port and returns its address.
+func start(t *testing.T, srv *SenSrv) string {
+	t.Helper()
+	srv.Start(srv)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go srv.StartListener(l)
+	return l.Addr().String()
+}
+
+// rawConn speaks warp9 over a bare connection, for tests that pick
+// their own tags. Clnt allocates tags itself and can't send a Tflush.
+type rawConn struct {
+	net.Conn
+	t *testing.T
+}
+
+// dial connects to addr and attaches fid 0 to the root.
+func dial(t *testing.T, addr string) *rawConn {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	rc := &rawConn{c, t}
+
+	rc.send(warp9.Tversion, warp9.NOTAG, u32(8192), str(warp9.Warp9Version))
+	rc.expect(warp9.Rversion, warp9.NOTAG)
+	rc.send(warp9.Tattach, 1, u32(0), u32(warp9.NOFID), u32(501), str(""))
+	rc.expect(warp9.Rattach, 1)
+	return rc
+}
+
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, v)
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+func str(s string) []byte { return append(u16(uint16(len(s))), s...) }
+
+func (c *rawConn) send(typ uint8, tag uint16, fields ...[]byte) {
+	c.t.Helper()
+	pkt := make([]byte, 7)
+	pkt[4] = typ
+	binary.LittleEndian.PutUint16(pkt[5:], tag)
+	for _, f := range fields {
+		pkt = append(pkt, f...)
+	}
+	binary.LittleEndian.PutUint32(pkt, uint32(len(pkt)))
+	if _, err := c.Write(pkt); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// recv returns the next message, or nil once the connection closes.
+func (c *rawConn) recv() *warp9.Fcall {
+	c.t.Helper()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(c, size); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			c.t.Fatal("no answer")
+		}
+		return nil
+	}
+	pkt := make([]byte, binary.LittleEndian.Uint32(size))
+	copy(pkt, size)
+	if _, err := io.ReadFull(c, pkt[4:]); err != nil {
+		c.t.Fatal(err)
+	}
+	fc, err, _ := warp9.Unpack(pkt)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return fc
+}
+
+// expect reads the next message and checks its type and tag.
+func (c *rawConn) expect(typ uint8, tag uint16) *warp9.Fcall {
+	c.t.Helper()
+	fc := c.recv()
+	if fc == nil {
+		c.t.Fatalf("connection closed; want type %d tag %d", typ, tag)
+	}
+	if fc.Type != typ || fc.Tag != tag {
+		c.t.Fatalf("got type %d tag %d, want type %d tag %d", fc.Type, fc.Tag, typ, tag)
+	}
+	return fc
+}
+
+// readdir reads fid's listing at off as a Tread would.
+func readdir(srv *SenSrv, fid *senFid, off uint64, count uint32) ([]byte, *warp9.WarpError) {
+	req := &warp9.SrvReq{
+		Tc:  &warp9.Fcall{Type: warp9.Tread, Offset: off, Count: count},
+		Fid: &warp9.SrvFid{Aux: fid},
+	}
+	return srv.readdir(req)
+}
+
+// Entries are shared by all fids: stats and listings of the same
+// entries at once must not race. Run with -race.
+func TestConcurrentStat(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	srv := NewSenSrv("stat", 0)
+	if err := srv.AddSensor("dev/temp"); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				for _, p := range []string{"firmware", "stats", "dev/temp"} {
+					if _, err := srv.lookup(p).stat(); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				for _, p := range []string{"", "dev"} {
+					fid := &senFid{entry: srv.lookup(p)}
+					if _, err := readdir(srv, fid, 0, 8192); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -5,33 +5,318 @@ package sensim
 
 import (
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/lavaorg/lrt/mlog"
 )
 
+const (
+	initialTemp     = 32.8
+	defaultInterval = time.Second
+	defaultHistory  = 1000 // readings kept for backfill
+	defaultNextWait = 30 * time.Second
+)
+
+// sensorItem serves the readings of a signal Model. The model is
+// sampled once per interval of the device clock, whether or not
+// anyone reads; a read returns the latest sample. Samples are taken
+// lazily, catching up on every interval that passed since the last
+// read, so idle sensors cost nothing.
 type sensorItem struct {
-	lasttemp float32
+	sync.Mutex
+	reads    int64 // answered reads of the sensor and its views; atomic
+	dev      *SenSrv
+	spec     *ModelSpec // rebuilt on reset; nil is the default model
+	model    Model
+	value    float64
+	seq      uint64    // samples taken
+	sampled  time.Time // time of the latest sample
+	next     time.Time // time of the next sample; zero until started
+	interval time.Duration
+	forced   bool          // value set by hand since the last reset
+	unit     string        // reported with structured readings
+	encoding string        // how Read encodes readings; "" is value
+	nextWait time.Duration // longest a read of the next view blocks
+
+	views map[string]*SenDir // encoded views, see SenSrv.view
+
+	// ring of the most recent readings
+	hist  []Reading
+	hnext int // slot of the next reading
+	hlen  int // readings held
 }
 
-func newSensorItem(sdir *SenDir) (*SenDir, error) {
-	var sensor sensorItem = sensorItem{32.8}
-	sdir.item = &sensor
-	return sdir, nil
+// sensorMaker returns an itemMaker for a sensor following spec.
+func (srv *SenSrv) sensorMaker(spec *ModelSpec) itemMaker {
+	return func(sdir *SenDir) (*SenDir, error) {
+		sensor := &sensorItem{dev: srv, spec: spec, hist: make([]Reading, defaultHistory), nextWait: defaultNextWait}
+		if err := sensor.reset(); err != nil {
+			return nil, err
+		}
+		sdir.item = sensor
+		return sdir, nil
+	}
 }
 
-func (s *sensorItem) Read() ([]byte, error) {
-	if s.lasttemp > 50 {
-		s.lasttemp = 28
+// AddSensorModel adds a sensor at path whose signal follows spec.
+func (srv *SenSrv) AddSensorModel(path string, spec *ModelSpec) error {
+	_, err := srv.addItem(path, srv.sensorMaker(spec))
+	return err
+}
+
+// reset restores the model to its initial state and restarts sampling.
+func (s *sensorItem) reset() error {
+	m := defaultModel()
+	if s.spec != nil {
+		var err error
+		if m, err = newModel(s.spec, s.dev.input); err != nil {
+			return err
+		}
+	}
+
+	s.Lock()
+	s.model = m
+	s.value = initialTemp
+	s.seq = 0
+	s.forced = false
+	s.hnext, s.hlen = 0, 0
+	s.interval = defaultInterval
+	s.next = s.dev.Clock().Now()
+	s.Unlock()
+	return nil
+}
+
+// restart begins sampling afresh at the current clock time.
+func (s *sensorItem) restart() {
+	s.Lock()
+	s.next = s.dev.Clock().Now()
+	s.Unlock()
+}
+
+// catchup takes every sample due up to now. Called with s locked.
+// After a long idle or fast-forward only the samples the history can
+// hold are taken; older ones are skipped (but counted), so a read
+// costs at most a history's worth of samples.
+func (s *sensorItem) catchup(now time.Time) {
+	keep := time.Duration(len(s.hist))
+	if keep == 0 {
+		keep = 1
+	}
+	if n := now.Sub(s.next) / s.interval; n > keep {
+		skip := n - keep
+		s.next = s.next.Add(skip * s.interval)
+		s.seq += uint64(skip)
+		s.hlen = 0 // the history no longer runs up to seq
+	}
+	for !s.next.After(now) {
+		s.value = s.model.Sample(s.next)
+		s.seq++
+		s.sampled = s.next
+		s.next = s.next.Add(s.interval)
+		s.record()
 	}
-	s.lasttemp += 5
-	return []byte(fmt.Sprintf("%f", s.lasttemp)), nil
 }
 
+// record adds the latest sample to the history. Called with s locked.
+func (s *sensorItem) record() {
+	if len(s.hist) == 0 {
+		return
+	}
+	s.hist[s.hnext] = s.latest()
+	s.hnext = (s.hnext + 1) % len(s.hist)
+	if s.hlen < len(s.hist) {
+		s.hlen++
+	}
+}
+
+// history returns up to max readings from sequence number seq on,
+// or from the oldest one held if seq is older.
+func (s *sensorItem) history(seq uint64, max int) []Reading {
+	s.Lock()
+	defer s.Unlock()
+	s.catchup(s.dev.Clock().Now())
+
+	oldest := s.seq - uint64(s.hlen) + 1
+	if seq < oldest {
+		seq = oldest
+	}
+	var rs []Reading
+	for ; seq <= s.seq && len(rs) < max; seq++ {
+		back := int(s.seq - seq) // 0 is the latest
+		i := (s.hnext - 1 - back + 2*len(s.hist)) % len(s.hist)
+		rs = append(rs, s.hist[i])
+	}
+	return rs
+}
+
+// setHistory resizes the history, keeping the latest readings.
+func (s *sensorItem) setHistory(n int) {
+	s.Lock()
+	defer s.Unlock()
+
+	hist := make([]Reading, n)
+	keep := s.hlen
+	if keep > n {
+		keep = n
+	}
+	for i := 0; i < keep; i++ {
+		j := (s.hnext - keep + i + 2*len(s.hist)) % len(s.hist)
+		hist[i] = s.hist[j]
+	}
+	s.hist, s.hlen = hist, keep
+	s.hnext = 0
+	if n > 0 {
+		s.hnext = keep % n
+	}
+}
+
+// set forces the current value. Models that can't be set are
+// replaced by a constant until the next reset.
+func (s *sensorItem) set(v float64) {
+	s.Lock()
+	s.catchup(s.dev.Clock().Now())
+	if m, ok := s.model.(Setter); ok {
+		m.Set(v)
+	} else {
+		s.model = &Constant{v}
+	}
+	s.value = v
+	s.forced = true
+	s.Unlock()
+}
+
+// setInterval takes effect after the next sample.
+func (s *sensorItem) setInterval(d time.Duration) {
+	s.Lock()
+	s.catchup(s.dev.Clock().Now())
+	s.interval = d
+	s.Unlock()
+}
+
+// setEncoding selects how Read encodes readings.
+func (s *sensorItem) setEncoding(enc string) error {
+	if err := checkEncoding(enc); err != nil {
+		return err
+	}
+	s.Lock()
+	s.encoding = enc
+	s.Unlock()
+	return nil
+}
+
+func (s *sensorItem) setUnit(unit string) {
+	s.Lock()
+	s.unit = unit
+	s.Unlock()
+}
+
+// reading returns the latest sample.
+func (s *sensorItem) reading() *Reading {
+	s.Lock()
+	defer s.Unlock()
+	s.catchup(s.dev.Clock().Now())
+	r := s.latest()
+	return &r
+}
+
+// latest is the current reading. Called with s locked.
+func (s *sensorItem) latest() Reading {
+	r := Reading{Time: s.sampled, Seq: s.seq, Value: s.value, Unit: s.unit, Quality: "good"}
+	if s.forced {
+		r.Quality = "forced"
+	}
+	return r
+}
+
+// wait blocks until there is a reading newer than sequence number
+// after, and returns it. It returns nil if cancel is closed or no
+// sample is taken within timeout.
+func (s *sensorItem) wait(after uint64, cancel <-chan struct{}, timeout time.Duration) *Reading {
+	expire := time.After(timeout)
+	for {
+		clock := s.dev.Clock()
+		now := clock.Now()
+		s.Lock()
+		s.catchup(now)
+		if s.seq > after {
+			r := s.latest()
+			s.Unlock()
+			return &r
+		}
+		due := s.next.Sub(now)
+		s.Unlock()
+
+		tick := clock.After(due)
+		select {
+		case <-tick:
+		case <-cancel:
+			stop(clock, tick)
+			return nil
+		case <-expire:
+			stop(clock, tick)
+			return nil
+		}
+	}
+}
+
+func (s *sensorItem) setNextWait(d time.Duration) {
+	s.Lock()
+	s.nextWait = d
+	s.Unlock()
+}
+
+// format returns the encoding Read uses.
+func (s *sensorItem) format() string {
+	s.Lock()
+	defer s.Unlock()
+	if s.encoding == "" {
+		return "value"
+	}
+	return s.encoding
+}
+
+func (s *sensorItem) Read() ([]byte, error) {
+	return s.reading().Encode(s.format())
+}
+
+// Stat dates the sensor by its latest sample.
 func (s *sensorItem) Stat(dir *SenDir) error {
 	mlog.Debug("s:%v; sd:%v", s, dir)
+	if r := s.reading(); !r.Time.IsZero() {
+		dir.Mtime = uint32(r.Time.Unix())
+	}
 	return nil
 }
 
 func (s *sensorItem) String() string {
-	return fmt.Sprintf("(temp:%v)", s.lasttemp)
+	s.Lock()
+	defer s.Unlock()
+	s.catchup(s.dev.Clock().Now())
+	return fmt.Sprintf("(value:%f seq:%d interval:%v model:%T)", s.value, s.seq, s.interval, s.model)
+}
+
+// configureSensor creates the sensor at path, or reconfigures the one
+// already there, to follow spec (nil for the default model). A zero
+// interval keeps the default.
+func (srv *SenSrv) configureSensor(path string, spec *ModelSpec, interval time.Duration) (*sensorItem, error) {
+	sdir := srv.lookup(path)
+	if sdir == nil {
+		var err error
+		if sdir, err = srv.addItem(path, srv.sensorMaker(spec)); err != nil {
+			return nil, err
+		}
+	}
+	s, ok := sdir.item.(*sensorItem)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a sensor", path)
+	}
+	s.spec = spec
+	if err := s.reset(); err != nil {
+		return nil, err
+	}
+	if interval > 0 {
+		s.setInterval(interval)
+	}
+	return s, nil
 }
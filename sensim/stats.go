@@ -0,0 +1,225 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package sensim
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lavaorg/warp/warp9"
+)
+
+// Traffic statistics. warp9 keeps its own connection counters
+// private, so a device counts requests itself as they are processed
+// and answered (warp9.SrvReqProcessOps). The stats object shows the
+// totals, each open connection and the reads of each sensor:
+//
+//	conns:1 closed:4 requests:57 errors:1 in:1520 out:2210
+//		types: attach:5 walk:12 open:10 read:20 clunk:10
+//		latency: <100us:50 <1ms:7 <10ms:0 <100ms:0 <1s:0 >=1s:0
+//	conn 127.0.0.1:50312 requests:9 errors:0 in:260 out:341
+//		types: attach:1 walk:3 open:2 read:2 clunk:1
+//		latency: <100us:9 <1ms:0 <10ms:0 <100ms:0 <1s:0 >=1s:0
+//	sensor sensors reads:20
+//
+// Byte counts are of whole messages.
+
+// latency histogram buckets, by upper bound
+var latencyBounds = []time.Duration{100 * time.Microsecond, time.Millisecond, 10 * time.Millisecond, 100 * time.Millisecond, time.Second}
+
+var latencyNames = []string{"<100us", "<1ms", "<10ms", "<100ms", "<1s", ">=1s"}
+
+// message names, in protocol order
+var msgTypes = []uint8{warp9.Tversion, warp9.Tauth, warp9.Tattach, warp9.Tflush, warp9.Twalk, warp9.Topen,
+	warp9.Tcreate, warp9.Tread, warp9.Twrite, warp9.Tclunk, warp9.Tremove, warp9.Tstat, warp9.Twstat}
+
+var msgNames = map[uint8]string{
+	warp9.Tversion: "version", warp9.Tauth: "auth", warp9.Tattach: "attach", warp9.Tflush: "flush",
+	warp9.Twalk: "walk", warp9.Topen: "open", warp9.Tcreate: "create", warp9.Tread: "read",
+	warp9.Twrite: "write", warp9.Tclunk: "clunk", warp9.Tremove: "remove", warp9.Tstat: "stat",
+	warp9.Twstat: "wstat",
+}
+
+// counters is the traffic of one connection, or of all of them.
+type counters struct {
+	requests int64
+	errors   int64
+	in, out  uint64 // message bytes
+	bytype   map[uint8]int64
+	latency  [6]int64 // see latencyBounds
+}
+
+func (c *counters) add(req *warp9.SrvReq, d time.Duration, timed bool) {
+	c.requests++
+	if req.Rc != nil {
+		if req.Rc.Type == warp9.Rerror {
+			c.errors++
+		}
+		c.out += uint64(len(req.Rc.Pkt))
+	}
+	c.in += uint64(len(req.Tc.Pkt))
+	if c.bytype == nil {
+		c.bytype = make(map[uint8]int64)
+	}
+	c.bytype[req.Tc.Type]++
+	if timed {
+		i := sort.Search(len(latencyBounds), func(i int) bool { return d < latencyBounds[i] })
+		c.latency[i]++
+	}
+}
+
+// String is the counters and their indented detail lines.
+func (c *counters) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "requests:%d errors:%d in:%d out:%d\n\ttypes:", c.requests, c.errors, c.in, c.out)
+	for _, t := range msgTypes {
+		if n := c.bytype[t]; n > 0 {
+			fmt.Fprintf(&b, " %s:%d", msgNames[t], n)
+		}
+	}
+	b.WriteString("\n\tlatency:")
+	for i, n := range c.latency {
+		fmt.Fprintf(&b, " %s:%d", latencyNames[i], n)
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// stats holds a device's counters.
+type stats struct {
+	sync.Mutex
+	total   counters
+	conns   map[*warp9.Conn]*counters
+	closed  int64
+	started map[*warp9.SrvReq]time.Time
+}
+
+func (st *stats) opened(conn *warp9.Conn) {
+	st.Lock()
+	if st.conns == nil {
+		st.conns = make(map[*warp9.Conn]*counters)
+	}
+	st.conns[conn] = new(counters)
+	st.Unlock()
+}
+
+func (st *stats) closedConn(conn *warp9.Conn) {
+	st.Lock()
+	if _, ok := st.conns[conn]; ok {
+		delete(st.conns, conn)
+		st.closed++
+	}
+	// requests left unanswered never end
+	for req := range st.started {
+		if req.Conn == conn {
+			delete(st.started, req)
+		}
+	}
+	st.Unlock()
+}
+
+func (st *stats) begin(req *warp9.SrvReq) {
+	st.Lock()
+	if st.started == nil {
+		st.started = make(map[*warp9.SrvReq]time.Time)
+	}
+	st.started[req] = time.Now()
+	st.Unlock()
+}
+
+func (st *stats) end(req *warp9.SrvReq) {
+	st.Lock()
+	defer st.Unlock()
+	t0, timed := st.started[req]
+	delete(st.started, req)
+	d := time.Since(t0)
+	st.total.add(req, d, timed)
+	if c := st.conns[req.Conn]; c != nil {
+		c.add(req, d, timed)
+	}
+}
+
+// summary is the one line form of the totals, for ctl status.
+func (st *stats) summary() string {
+	st.Lock()
+	defer st.Unlock()
+	return fmt.Sprintf("conns:%d requests:%d errors:%d", len(st.conns), st.total.requests, st.total.errors)
+}
+
+func (srv *SenSrv) SrvReqProcess(req *warp9.SrvReq) {
+	srv.stats.begin(req)
+	req.Process()
+}
+
+func (srv *SenSrv) SrvReqRespond(req *warp9.SrvReq) {
+	srv.stats.end(req)
+	srv.answered(req)
+	if req.Rc != nil && req.Rc.Type == warp9.Rread && req.Fid != nil {
+		if sfid, ok := req.Fid.Aux.(*senFid); ok {
+			if s := sensorOf(sfid.entry); s != nil {
+				atomic.AddInt64(&s.reads, 1)
+			}
+		}
+	}
+	req.PostProcess()
+}
+
+// sensorOf returns the sensor whose readings d serves, or nil.
+func sensorOf(d *SenDir) *sensorItem {
+	if d == nil {
+		return nil
+	}
+	switch it := d.item.(type) {
+	case *sensorItem:
+		return it
+	case *sensorView:
+		return it.s
+	case *historyItem:
+		return it.s
+	case *nextItem:
+		return it.s
+	}
+	return nil
+}
+
+// statsItem serves the statistics of a device.
+type statsItem struct {
+	srv *SenSrv
+}
+
+func (it *statsItem) Stat(dir *SenDir) error { return nil }
+
+func (it *statsItem) Read() ([]byte, error) {
+	srv := it.srv
+	st := &srv.stats
+	var b strings.Builder
+
+	st.Lock()
+	fmt.Fprintf(&b, "conns:%d closed:%d %v", len(st.conns), st.closed, &st.total)
+	var conns []string
+	for conn, c := range st.conns {
+		conns = append(conns, fmt.Sprintf("conn %s %v", conn.Id, c))
+	}
+	st.Unlock()
+	sort.Strings(conns)
+	for _, c := range conns {
+		b.WriteString(c)
+	}
+
+	var sensors []string
+	srv.each(func(d *SenDir) {
+		if s, ok := d.item.(*sensorItem); ok {
+			sensors = append(sensors, fmt.Sprintf("sensor %s reads:%d\n", srv.pathOf(d), atomic.LoadInt64(&s.reads)))
+		}
+	})
+	sort.Strings(sensors)
+	for _, s := range sensors {
+		b.WriteString(s)
+	}
+	return []byte(b.String()), nil
+}
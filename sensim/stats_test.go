@@ -0,0 +1,111 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package sensim
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lavaorg/warp/warp9"
+)
+
+// statsText reads the stats object of srv.
+func statsText(t *testing.T, srv *SenSrv) string {
+	t.Helper()
+	b, err := srv.lookup("stats").item.(*statsItem).Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+var latencyLine = regexp.MustCompile(`latency:((?: \S+:\d+)+)`)
+
+// latencies sums the first latency histogram in text.
+func latencies(t *testing.T, text string) int {
+	t.Helper()
+	m := latencyLine.FindStringSubmatch(text)
+	if m == nil {
+		t.Fatalf("no latency line in %q", text)
+	}
+	sum := 0
+	for _, f := range strings.Fields(m[1]) {
+		n, _ := strconv.Atoi(f[strings.IndexByte(f, ':')+1:])
+		sum += n
+	}
+	return sum
+}
+
+// Every request answered is counted, by connection, type and
+// latency, and every read of a sensor.
+func TestStats(t *testing.T) {
+	srv := NewSenSrv("stats", 0)
+	if err := srv.AddSensor("dev/temp"); err != nil {
+		t.Fatal(err)
+	}
+	c := dial(t, start(t, srv))
+
+	c.walk(2, 0, 1, "dev", "temp")
+	c.expect(warp9.Rwalk, 2)
+	c.walk(3, 0, 2, "dev", "missing")
+	c.expect(warp9.Rerror, 3)
+	c.send(warp9.Topen, 4, u32(1), []byte{warp9.OREAD})
+	c.expect(warp9.Ropen, 4)
+	for tag := uint16(5); tag < 7; tag++ {
+		c.send(warp9.Tread, tag, u32(1), u32(0), u32(0), u32(100))
+		c.expect(warp9.Rread, tag)
+	}
+	c.send(warp9.Tstat, 7, u32(1))
+	c.expect(warp9.Rstat, 7)
+
+	// version, attach and the six above
+	text := statsText(t, srv)
+	lines := strings.Split(text, "\n")
+	if !strings.HasPrefix(lines[0], "conns:1 closed:0 requests:8 errors:1 ") {
+		t.Errorf("totals %q", lines[0])
+	}
+	if want := "\ttypes: version:1 attach:1 walk:2 open:1 read:2 stat:1"; lines[1] != want {
+		t.Errorf("types %q, want %q", lines[1], want)
+	}
+	if n := latencies(t, text); n != 8 {
+		t.Errorf("%d requests timed, want 8", n)
+	}
+	if !strings.Contains(text, "\nconn ") || !strings.Contains(text, " requests:8 errors:1 ") {
+		t.Errorf("no line for the connection in %q", text)
+	}
+	if !strings.Contains(text, "sensor dev/temp reads:2\n") {
+		t.Errorf("sensor reads not counted in %q", text)
+	}
+	if s, _ := srv.Command("status"); !strings.Contains(s, "conns:1 requests:8 errors:1") {
+		t.Errorf("status %q", s)
+	}
+
+	// a closed connection leaves the totals
+	c.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.HasPrefix(statsText(t, srv), "conns:0 closed:1 requests:8 ") {
+		if time.Now().After(deadline) {
+			t.Fatalf("stats after close: %q", statsText(t, srv))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLatencyBuckets(t *testing.T) {
+	req := &warp9.SrvReq{Tc: &warp9.Fcall{Type: warp9.Tread}}
+	var c counters
+	for _, d := range []time.Duration{0, 99 * time.Microsecond, 100 * time.Microsecond, 5 * time.Millisecond, 2 * time.Second} {
+		c.add(req, d, true)
+	}
+	c.add(req, time.Hour, false) // not timed
+	if want := [6]int64{2, 1, 1, 0, 0, 1}; c.latency != want {
+		t.Errorf("buckets %v, want %v", c.latency, want)
+	}
+	if c.requests != 6 || c.bytype[warp9.Tread] != 6 {
+		t.Errorf("%d requests, %d reads", c.requests, c.bytype[warp9.Tread])
+	}
+}
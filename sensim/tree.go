@@ -0,0 +1,147 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package sensim
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/lavaorg/warp/warp9"
+)
+
+// itemMaker attaches an item to a newly created entry.
+type itemMaker func(sdir *SenDir) (*SenDir, error)
+
+// walk1 returns the entry name within directory d, or nil.
+func (srv *SenSrv) walk1(d *SenDir, name string) *SenDir {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	switch name {
+	case "", ".":
+		return d
+	case "..":
+		return d.parent
+	}
+	return d.children[name]
+}
+
+// lookup finds the entry for a slash separated path from the root.
+func (srv *SenSrv) lookup(path string) *SenDir {
+	d := srv.root
+	for _, name := range splitPath(path) {
+		if d = srv.walk1(d, name); d == nil {
+			return nil
+		}
+	}
+	return d
+}
+
+// children returns the entries of directory d.
+func (srv *SenSrv) children(d *SenDir) []*SenDir {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	kids := make([]*SenDir, 0, len(d.children))
+	for _, c := range d.children {
+		kids = append(kids, c)
+	}
+	return kids
+}
+
+// each calls f for every entry below the root.
+func (srv *SenSrv) each(f func(d *SenDir)) {
+	var walk func(d *SenDir)
+	walk = func(d *SenDir) {
+		for _, c := range srv.children(d) {
+			f(c)
+			if c.children != nil {
+				walk(c)
+			}
+		}
+	}
+	walk(srv.root)
+}
+
+// Mkdir creates the directory path, and any missing parents.
+func (srv *SenSrv) Mkdir(path string) (*SenDir, error) {
+	d := srv.root
+	for _, name := range splitPath(path) {
+		next := srv.walk1(d, name)
+		if next == nil {
+			next = srv.newSenDir(name, true)
+			if err := srv.link(d, next); err != nil {
+				return nil, err
+			}
+		}
+		if next.Mode&warp9.DMDIR == 0 {
+			return nil, errors.New("not a directory: " + name)
+		}
+		d = next
+	}
+	return d, nil
+}
+
+// AddSensor adds a simulated sensor at path, e.g. "sensors/temp1".
+func (srv *SenSrv) AddSensor(path string) error {
+	_, err := srv.addItem(path, srv.sensorMaker(nil))
+	return err
+}
+
+// addItem creates an object at path using mk, making any
+// missing parent directories.
+func (srv *SenSrv) addItem(path string, mk itemMaker) (*SenDir, error) {
+	names := splitPath(path)
+	if len(names) == 0 {
+		return nil, errors.New("empty path")
+	}
+	dir, err := srv.Mkdir(strings.Join(names[:len(names)-1], "/"))
+	if err != nil {
+		return nil, err
+	}
+	sdir, err := mk(srv.newSenDir(names[len(names)-1], false))
+	if err != nil {
+		return nil, err
+	}
+	if err = srv.link(dir, sdir); err != nil {
+		return nil, err
+	}
+	return sdir, nil
+}
+
+// link adds child to directory d.
+func (srv *SenSrv) link(d, child *SenDir) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if _, ok := d.children[child.Name]; ok {
+		return errors.New("exists: " + child.Name)
+	}
+	child.parent = d
+	d.children[child.Name] = child
+	return nil
+}
+
+func splitPath(path string) []string {
+	var names []string
+	for _, n := range strings.Split(path, "/") {
+		if n != "" && n != "." {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+// pathOf returns the slash separated path of d from the root;
+// the root itself is "".
+func (srv *SenSrv) pathOf(d *SenDir) string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	var names []string
+	for ; d != srv.root && d != nil; d = d.parent {
+		names = append([]string{d.Name}, names...)
+	}
+	return strings.Join(names, "/")
+}
@@ -0,0 +1,68 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package sensim
+
+import (
+	"testing"
+
+	"github.com/lavaorg/warp/warp9"
+)
+
+// walk sends a Twalk of names from fid to newfid.
+func (c *rawConn) walk(tag uint16, fid, newfid uint32, names ...string) {
+	c.t.Helper()
+	fields := [][]byte{u32(fid), u32(newfid), u16(uint16(len(names)))}
+	for _, n := range names {
+		fields = append(fields, str(n))
+	}
+	c.send(warp9.Twalk, tag, fields...)
+}
+
+// A walk of several elements ends at the last one and fails if any
+// is missing.
+func TestWalk(t *testing.T) {
+	srv := NewSenSrv("walk", 0)
+	if err := srv.AddSensor("dev/room/temp"); err != nil {
+		t.Fatal(err)
+	}
+	c := dial(t, start(t, srv))
+
+	for i, tc := range []struct {
+		names []string
+		want  string // path of the entry walked to
+	}{
+		{[]string{"dev", "room", "temp"}, "dev/room/temp"},
+		{[]string{"dev", "room", "..", "room", "temp"}, "dev/room/temp"},
+		{[]string{"dev", ".", "room"}, "dev/room"},
+		{[]string{"..", "info", "serial"}, "info/serial"},
+		{nil, ""},
+	} {
+		tag := uint16(10 + i)
+		c.walk(tag, 0, uint32(1+i), tc.names...)
+		fc := c.expect(warp9.Rwalk, tag)
+		if want := srv.lookup(tc.want).Qid; fc.Qid != want {
+			t.Errorf("walk %v: qid %v, want %v of %s", tc.names, fc.Qid, want, tc.want)
+		}
+	}
+
+	// a view of a sensor is reached as the last element
+	c.walk(20, 0, 20, "dev", "room", "temp.json")
+	fc := c.expect(warp9.Rwalk, 20)
+	if v := srv.view(srv.lookup("dev/room"), "temp.json"); v == nil || fc.Qid != v.Qid {
+		t.Errorf("walk to a view: qid %v", fc.Qid)
+	}
+
+	for i, names := range [][]string{
+		{"dev", "missing", "temp"},
+		{"dev", "room", "temp", "more"},
+		{"dev", "room", "missing"},
+	} {
+		tag := uint16(30 + i)
+		c.walk(tag, 0, 30, names...)
+		c.expect(warp9.Rerror, tag)
+	}
+	// the failed walks left nothing behind on the new fid
+	c.send(warp9.Tstat, 40, u32(30))
+	c.expect(warp9.Rerror, 40)
+}
@@ -0,0 +1,14 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package ufs
+
+import (
+	"syscall"
+	"time"
+)
+
+// atime is the last access time in st.
+func atime(st *syscall.Stat_t) time.Time {
+	return time.Unix(st.Atim.Unix())
+}
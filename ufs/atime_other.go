@@ -0,0 +1,17 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+//go:build !linux
+// +build !linux
+
+package ufs
+
+import (
+	"syscall"
+	"time"
+)
+
+// atime is only implemented for linux; elsewhere access times read as 0.
+func atime(st *syscall.Stat_t) time.Time {
+	return time.Unix(0, 0)
+}
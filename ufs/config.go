@@ -0,0 +1,107 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package ufs
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// Config holds the export settings that can be changed while serving.
+type Config struct {
+	Root     string   `json:"root"`
+	ReadOnly bool     `json:"readonly"`
+	Allow    []string `json:"allow"` // addresses or CIDRs; "unix" admits unix socket clients
+}
+
+// LoadConfig reads a JSON encoded Config from file. Settings the
+// file leaves out keep their values in base (e.g. the command line
+// settings).
+func LoadConfig(file string, base *Config) (*Config, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	cfg := new(Config)
+	if base != nil {
+		*cfg = *base
+	}
+	if err = json.Unmarshal(b, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, cfg.Check()
+}
+
+// Check reports if cfg can be served: the root must be an absolute path.
+func (cfg *Config) Check() error {
+	if cfg.Root == "" {
+		return errors.New("config: no root")
+	}
+	if !filepath.IsAbs(cfg.Root) {
+		return errors.New("config: root " + cfg.Root + " is not absolute")
+	}
+	return nil
+}
+
+// Reconfigure replaces the export settings. Existing connections
+// stay up: open fids keep their paths, new attaches use the new
+// root and allow list, and the read-only setting applies at once.
+func (u *Ufs) Reconfigure(cfg *Config) {
+	u.cfgmu.Lock()
+	u.Root = cfg.Root
+	u.ReadOnly = cfg.ReadOnly
+	u.Allow = cfg.Allow
+	u.cfgmu.Unlock()
+}
+
+func (u *Ufs) config() *Config {
+	u.cfgmu.RLock()
+	defer u.cfgmu.RUnlock()
+	return &Config{u.Root, u.ReadOnly, u.Allow}
+}
+
+func (u *Ufs) readOnly(fid *ufsFid) bool {
+	return fid.ro || u.config().ReadOnly
+}
+
+// allowed reports if a client at addr may attach.
+func (cfg *Config) allowed(addr net.Addr) bool {
+	if len(cfg.Allow) == 0 {
+		return true
+	}
+
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UnixAddr:
+		for _, s := range cfg.Allow {
+			if s == "unix" {
+				return true
+			}
+		}
+		return false
+	default:
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			ip = net.ParseIP(host)
+		}
+	}
+	if ip == nil {
+		return false
+	}
+
+	for _, s := range cfg.Allow {
+		if _, n, err := net.ParseCIDR(s); err == nil {
+			if n.Contains(ip) {
+				return true
+			}
+		} else if a := net.ParseIP(s); a != nil && a.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package ufs
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "cfg.json")
+	base := &Config{Root: "/srv", ReadOnly: true}
+
+	for _, tc := range []struct {
+		json string
+		want *Config // nil if refused
+	}{
+		{`{}`, base},
+		{`{"allow": ["unix"]}`, &Config{Root: "/srv", ReadOnly: true, Allow: []string{"unix"}}},
+		{`{"root": "/data", "readonly": false}`, &Config{Root: "/data"}},
+		{`{"root": ""}`, nil},
+		{`{"root": "data"}`, nil},
+		{`{"root": `, nil},
+	} {
+		writeFile(t, file, tc.json)
+		cfg, err := LoadConfig(file, base)
+		switch {
+		case tc.want == nil && err == nil:
+			t.Errorf("%s: accepted as %+v", tc.json, cfg)
+		case tc.want != nil && err != nil:
+			t.Errorf("%s: %v", tc.json, err)
+		case tc.want != nil && !reflect.DeepEqual(cfg, tc.want):
+			t.Errorf("%s: got %+v, want %+v", tc.json, cfg, tc.want)
+		}
+	}
+
+	writeFile(t, file, `{"readonly": false}`)
+	if _, err := LoadConfig(file, nil); err == nil {
+		t.Errorf("config without a root accepted")
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package ufs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lavaorg/warp/warp9"
+)
+
+// SrvReqProcess tracks each request so Shutdown can wait for
+// outstanding work. Once draining, new requests are refused, except
+// clunks and flushes, which let clients release what they hold.
+func (u *Ufs) SrvReqProcess(req *warp9.SrvReq) {
+	u.drainmu.Lock()
+	if u.draining && req.Tc.Type != warp9.Tclunk && req.Tc.Type != warp9.Tflush {
+		u.drainmu.Unlock()
+		req.RespondError(warp9.Error(EUFSshutdown))
+		return
+	}
+	if u.inflight == nil {
+		u.inflight = make(map[*warp9.SrvReq]bool)
+	}
+	u.inflight[req] = true
+	u.drainmu.Unlock()
+
+	req.Process()
+}
+
+func (u *Ufs) SrvReqRespond(req *warp9.SrvReq) {
+	req.PostProcess()
+
+	u.drainmu.Lock()
+	delete(u.inflight, req)
+	u.drainmu.Unlock()
+}
+
+func (u *Ufs) trackFile(fid *ufsFid) {
+	u.drainmu.Lock()
+	if u.files == nil {
+		u.files = make(map[*ufsFid]bool)
+	}
+	u.files[fid] = true
+	u.drainmu.Unlock()
+}
+
+func (u *Ufs) untrackFile(fid *ufsFid) {
+	u.drainmu.Lock()
+	delete(u.files, fid)
+	u.drainmu.Unlock()
+}
+
+// Shutdown refuses new requests, waits up to timeout for outstanding
+// ones to be answered, then syncs and closes every open file and
+// removes every snapshot copy. Files still in use by a request that
+// outlived the timeout are left open. The caller should stop
+// accepting connections first.
+func (u *Ufs) Shutdown(timeout time.Duration) error {
+	u.drainmu.Lock()
+	u.draining = true
+	u.drainmu.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	pending := 0
+	for {
+		u.drainmu.Lock()
+		pending = len(u.inflight)
+		u.drainmu.Unlock()
+		if pending == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	u.drainmu.Lock()
+	files := u.files
+	u.files = nil
+	u.drainmu.Unlock()
+
+	busy := 0
+	for fid := range files {
+		if !fid.mu.TryLock() {
+			busy++
+			continue
+		}
+		if fid.file != nil {
+			fid.file.Sync()
+			fid.file.Close()
+			fid.file = nil
+		}
+		fid.mu.Unlock()
+	}
+	// connections are not closed before exit, so their snapshots
+	// must be released here
+	u.releaseAllSnapshots()
+
+	if pending > 0 {
+		return fmt.Errorf("ufs: %d requests still pending at shutdown, %d files busy", pending, busy)
+	}
+	return nil
+}
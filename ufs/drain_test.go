@@ -0,0 +1,82 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package ufs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lavaorg/warp/warp9"
+)
+
+func TestShutdown(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "a"), "data")
+	u := &Ufs{Root: root}
+	c9 := serve(t, u)
+
+	obj, err := c9.Open("a", warp9.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Shutdown(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c9.Stat("a"); err == nil {
+		t.Errorf("stat while draining succeeded")
+	}
+	// clients can still let go of their fids
+	if err := c9.Clunk(obj.Fid); err != nil {
+		t.Errorf("clunk while draining: %v", err)
+	}
+}
+
+// Snapshots are released at shutdown, as their connections are not
+// closed before the server exits.
+func TestShutdownSnapshots(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "a"), "data")
+	stage := t.TempDir()
+	u := &Ufs{Root: root, SnapDir: stage}
+	addr := start(t, u)
+
+	user := warp9.Identity.User(uint32(os.Getuid()))
+	for i := 0; i < 2; i++ {
+		c9, err := warp9.Mount("tcp", addr, SnapPrefix+"/", 8192, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c9.Unmount()
+	}
+	if ents, _ := os.ReadDir(stage); len(ents) != 2 {
+		t.Fatalf("%d snapshots staged, want 2", len(ents))
+	}
+
+	if err := u.Shutdown(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if ents, _ := os.ReadDir(stage); len(ents) != 0 {
+		t.Errorf("%d snapshots left after shutdown", len(ents))
+	}
+}
+
+// Connections keep the root they attached under.
+func TestReconfigureRoot(t *testing.T) {
+	old := t.TempDir()
+	writeFile(t, filepath.Join(old, "a"), "data")
+	u := &Ufs{Root: old}
+	c9 := serve(t, u)
+
+	u.Reconfigure(&Config{Root: t.TempDir()})
+
+	if err := link(c9, "b", "/a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(old, "b")); got != "data" {
+		t.Errorf("b = %q, want data", got)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package ufs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+
+	"github.com/lavaorg/warp/warp9"
+)
+
+// warp9 unpacks messages in each connection's receive loop, where a
+// malformed one (e.g. a Twstat whose stat is cut short) panics and
+// takes the whole server down. StartListener therefore hands warp9
+// connections that check every message first and fail the read
+// and close instead, which ends just that connection.
+
+var errBadMsg = errors.New("ufs: malformed message")
+
+// StartListener serves the connections accepted on l, like
+// warp9.Srv.StartListener, with every message checked.
+func (u *Ufs) StartListener(l net.Listener) error {
+	return u.Srv.StartListener(checkedListener{l})
+}
+
+type checkedListener struct {
+	net.Listener
+}
+
+func (l checkedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &checkedConn{Conn: c, rd: bufio.NewReader(c)}, nil
+}
+
+// checkedConn reads whole messages and passes on those warp9 can unpack.
+type checkedConn struct {
+	net.Conn
+	rd  *bufio.Reader
+	msg []byte // unread part of the current message
+}
+
+func (c *checkedConn) Read(b []byte) (int, error) {
+	if len(c.msg) == 0 {
+		var size [4]byte
+		if _, err := io.ReadFull(c.rd, size[:]); err != nil {
+			return 0, err
+		}
+		n := binary.LittleEndian.Uint32(size[:])
+		if n < 7 || n > 16<<20 {
+			return 0, errBadMsg
+		}
+		msg := make([]byte, n)
+		copy(msg, size[:])
+		if _, err := io.ReadFull(c.rd, msg[4:]); err != nil {
+			return 0, err
+		}
+		if !unpacks(msg) {
+			log.Printf("%v: %v\n", c.RemoteAddr(), errBadMsg)
+			c.Conn.Close()
+			return 0, errBadMsg
+		}
+		c.msg = msg
+	}
+	n := copy(b, c.msg)
+	c.msg = c.msg[n:]
+	return n, nil
+}
+
+// unpacks reports if msg unpacks without a panic; warp9 deals with
+// the errors it returns.
+func unpacks(msg []byte) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	warp9.Unpack(msg)
+	return true
+}
@@ -0,0 +1,22 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package ufs
+
+import (
+	"os"
+	"syscall"
+)
+
+// FICLONE from linux/fs.h
+const ficlone = 0x40049409
+
+// reflink makes dst share src's data blocks (copy-on-write).
+// Fails on filesystems without reflink support (e.g. ext4).
+func reflink(dst, src *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
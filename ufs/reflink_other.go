@@ -0,0 +1,17 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+//go:build !linux
+// +build !linux
+
+package ufs
+
+import (
+	"errors"
+	"os"
+)
+
+// reflink is only implemented for linux; snapshots fall back to hard links.
+func reflink(dst, src *os.File) error {
+	return errors.New("reflink not supported")
+}
@@ -0,0 +1,255 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package ufs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/lavaorg/warp/warp9"
+)
+
+// SnapPrefix marks an attach name as a request for a snapshot view.
+// Attaching with aname "snap:/some/dir" presents a read-only copy of
+// Root/some/dir as it was at attach time. The copy is released when
+// the connection that attached to it closes.
+const SnapPrefix = "snap:"
+
+// DefaultSnapMax is the default limit on the bytes of file data a
+// snapshot may hold (see Ufs.SnapMax).
+const DefaultSnapMax = 1 << 30
+
+var errSnapTooBig = errors.New("snapshot: tree exceeds size limit")
+
+// snapshot is a point-in-time copy of part of the export.
+//
+// Regular files are cloned with a reflink (copy-on-write) when the host
+// filesystem supports it. Otherwise they are hard linked, which only
+// freezes files that writers replace (write new, rename over) rather than
+// rewrite in place. When neither works (e.g. SnapDir is on another
+// filesystem) the file contents are copied.
+//
+// Snapshots are staged in SnapDir, which the copy never descends
+// into, so a tree holding the staging area (e.g. "/") can still be
+// snapshot. An explicitly set SnapDir inside the tree is refused.
+type snapshot struct {
+	base string // temporary directory holding the copy
+	dir  string // root of the copied tree inside base
+}
+
+func (ufs *Ufs) takeSnapshot(conn *warp9.Conn, src string) (*snapshot, error) {
+	max := ufs.SnapMax
+	if max == 0 {
+		max = DefaultSnapMax
+	}
+	snap, err := newSnapshot(ufs.SnapDir, src, max)
+	if err != nil {
+		return nil, err
+	}
+
+	ufs.snapmu.Lock()
+	if ufs.snaps == nil {
+		ufs.snaps = make(map[*warp9.Conn][]*snapshot)
+	}
+	ufs.snaps[conn] = append(ufs.snaps[conn], snap)
+	ufs.snapmu.Unlock()
+	return snap, nil
+}
+
+func (ufs *Ufs) releaseSnapshots(conn *warp9.Conn) {
+	ufs.snapmu.Lock()
+	snaps := ufs.snaps[conn]
+	delete(ufs.snaps, conn)
+	ufs.snapmu.Unlock()
+
+	for _, snap := range snaps {
+		snap.release()
+	}
+}
+
+// releaseAllSnapshots releases the snapshots of every connection.
+func (ufs *Ufs) releaseAllSnapshots() {
+	ufs.snapmu.Lock()
+	snaps := ufs.snaps
+	ufs.snaps = nil
+	ufs.snapmu.Unlock()
+
+	for _, held := range snaps {
+		for _, snap := range held {
+			snap.release()
+		}
+	}
+}
+
+// newSnapshot copies src into a new directory in snapdir, failing
+// if the copy would hold more than max bytes of file data (max < 0
+// for no limit).
+func newSnapshot(snapdir, src string, max int64) (*snapshot, error) {
+	explicit := snapdir != ""
+	if !explicit {
+		snapdir = os.TempDir()
+	}
+	stage, err := realPath(snapdir)
+	if err != nil {
+		return nil, err
+	}
+	if explicit {
+		if s, err := realPath(src); err == nil && within(stage, s) {
+			return nil, fmt.Errorf("snapshot: snapdir %s is inside %s", snapdir, src)
+		}
+	}
+	base, err := os.MkdirTemp(stage, "ufs-snap-")
+	if err != nil {
+		return nil, err
+	}
+
+	name := filepath.Base(src)
+	if name == "/" || name == "." {
+		name = "root"
+	}
+	snap := &snapshot{base: base, dir: filepath.Join(base, name)}
+	if err = copyTree(src, snap.dir, stage, max); err != nil {
+		snap.release()
+		return nil, err
+	}
+	return snap, nil
+}
+
+// staged reports if the directory p is stage or a snapshot in it.
+func staged(p, stage string) bool {
+	return p == stage || filepath.Dir(p) == stage && strings.HasPrefix(filepath.Base(p), "ufs-snap-")
+}
+
+// realPath is p made absolute with symlinks resolved.
+func realPath(p string) (string, error) {
+	p, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(p)
+}
+
+// within reports if p is dir or lies below it.
+func within(p, dir string) bool {
+	return dir == "/" || p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// release removes the copy. Directories are made writable first since
+// the copy preserves the original (possibly read-only) permissions.
+func (snap *snapshot) release() {
+	filepath.Walk(snap.base, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && fi.IsDir() {
+			os.Chmod(p, 0700)
+		}
+		return nil
+	})
+	os.RemoveAll(snap.base)
+}
+
+// copyTree copies src to dst, leaving out the staging directory
+// stage and the snapshots in it. Directories are created writable while being filled and get
+// their original mode and times once the walk is complete. Devices,
+// pipes and sockets are skipped. It fails once the regular files
+// copied total more than max bytes, unless max < 0.
+func copyTree(src, dst, stage string, max int64) error {
+	var dirs []string
+	var size int64
+	modes := make(map[string]os.FileInfo)
+
+	// compare real paths against stage, as src may be reached by a symlink
+	real, err := realPath(src)
+	if err != nil {
+		return err
+	}
+
+	err = filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case fi.IsDir():
+			if rel != "." && staged(filepath.Join(real, rel), stage) {
+				return filepath.SkipDir
+			}
+			if err := os.Mkdir(target, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, target)
+			modes[target] = fi
+
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+
+		case fi.Mode().IsRegular():
+			if size += fi.Size(); max >= 0 && size > max {
+				return errSnapTooBig
+			}
+			return cloneFile(p, target, fi)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// deepest first so setting a parent's mode can't block its children
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, d := range dirs {
+		fi := modes[d]
+		os.Chmod(d, fi.Mode().Perm())
+		os.Chtimes(d, fi.ModTime(), fi.ModTime())
+	}
+	return nil
+}
+
+// cloneFile makes dst a frozen copy of src: a reflink if possible,
+// else a hard link, else a full copy.
+func cloneFile(src, dst string, fi os.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if reflink(out, in) == nil {
+		out.Close()
+		return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+	}
+	out.Close()
+	os.Remove(dst)
+
+	if os.Link(src, dst) == nil {
+		return nil
+	}
+
+	out, err = os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	out.Close()
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+}
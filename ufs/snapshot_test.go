@@ -0,0 +1,164 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package ufs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lavaorg/warp/warp9"
+)
+
+func writeFile(t *testing.T, p, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, p string) string {
+	t.Helper()
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestSnapshotFrozen(t *testing.T) {
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "a"), "one")
+	writeFile(t, filepath.Join(src, "sub", "b"), "two")
+	os.Symlink("a", filepath.Join(src, "ln"))
+
+	snap, err := newSnapshot(t.TempDir(), src, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.release()
+
+	// writers replace files; the snapshot keeps the old contents
+	writeFile(t, filepath.Join(src, "a.new"), "changed")
+	os.Rename(filepath.Join(src, "a.new"), filepath.Join(src, "a"))
+	writeFile(t, filepath.Join(src, "c"), "new")
+
+	if got := readFile(t, filepath.Join(snap.dir, "a")); got != "one" {
+		t.Errorf("a = %q, want %q", got, "one")
+	}
+	if got := readFile(t, filepath.Join(snap.dir, "sub", "b")); got != "two" {
+		t.Errorf("sub/b = %q, want %q", got, "two")
+	}
+	if l, err := os.Readlink(filepath.Join(snap.dir, "ln")); err != nil || l != "a" {
+		t.Errorf("ln = %q, %v; want a", l, err)
+	}
+	if _, err := os.Stat(filepath.Join(snap.dir, "c")); err == nil {
+		t.Errorf("file created after the snapshot is in it")
+	}
+
+	snap.release()
+	if _, err := os.Stat(snap.base); !os.IsNotExist(err) {
+		t.Errorf("release left %s: %v", snap.base, err)
+	}
+}
+
+// A tree holding the staging directory must not copy itself.
+func TestSnapshotSkipsStage(t *testing.T) {
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "a"), "one")
+	stage := filepath.Join(src, "stage")
+	os.Mkdir(stage, 0700)
+
+	// explicitly configured inside the tree: refused
+	if snap, err := newSnapshot(stage, src, -1); err == nil {
+		snap.release()
+		t.Fatal("snapdir inside the tree was accepted")
+	}
+
+	// the default staging dir is skipped, along with other snapshots
+	tmp := os.Getenv("TMPDIR")
+	os.Setenv("TMPDIR", stage)
+	defer os.Setenv("TMPDIR", tmp)
+
+	other, err := newSnapshot("", src, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.release()
+	snap, err := newSnapshot("", src, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.release()
+
+	ents, err := os.ReadDir(snap.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range ents {
+		if e.Name() != "a" {
+			t.Errorf("snapshot holds %s", e.Name())
+		}
+	}
+}
+
+func TestSnapshotRoot(t *testing.T) {
+	stage := t.TempDir()
+	tmp := os.Getenv("TMPDIR")
+	os.Setenv("TMPDIR", stage)
+	defer os.Setenv("TMPDIR", tmp)
+
+	// copying all of "/" would take too long: a zero limit stops the
+	// copy at the first file, past naming the copy and skipping stage
+	snap, err := newSnapshot("", "/", 0)
+	if err == nil {
+		snap.release()
+		t.Fatal("snapshot of / fit in a zero limit")
+	}
+	if os.IsExist(err) {
+		t.Fatalf("snapshot of /: %v", err)
+	}
+	if ents, _ := os.ReadDir(stage); len(ents) != 0 {
+		t.Errorf("failed snapshot left %d entries", len(ents))
+	}
+}
+
+func TestSnapshotLimit(t *testing.T) {
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "a"), "0123456789")
+	writeFile(t, filepath.Join(src, "b"), "0123456789")
+
+	if _, err := newSnapshot(t.TempDir(), src, 15); err != errSnapTooBig {
+		t.Errorf("20 bytes under a 15 byte limit: %v, want %v", err, errSnapTooBig)
+	}
+	snap, err := newSnapshot(t.TempDir(), src, 20)
+	if err != nil {
+		t.Fatalf("20 bytes under a 20 byte limit: %v", err)
+	}
+	snap.release()
+}
+
+// A snapshot attach name may not reach outside the export.
+func TestSnapshotOutsideRoot(t *testing.T) {
+	outside := t.TempDir()
+	writeFile(t, filepath.Join(outside, "secret"), "secret")
+	root := t.TempDir()
+	os.Symlink(outside, filepath.Join(root, "out"))
+	stage := t.TempDir()
+	addr := start(t, &Ufs{Root: root, SnapDir: stage})
+
+	user := warp9.Identity.User(uint32(os.Getuid()))
+	for _, src := range []string{"../../..", "../" + filepath.Base(outside), "out"} {
+		if c9, err := warp9.Mount("tcp", addr, SnapPrefix+src, 8192, user); err == nil {
+			c9.Unmount()
+			t.Errorf("snapshot of %s outside the root succeeded", src)
+		}
+	}
+	if ents, _ := os.ReadDir(stage); len(ents) != 0 {
+		t.Errorf("%d snapshots staged outside the root", len(ents))
+	}
+}
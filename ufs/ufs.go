@@ -4,9 +4,16 @@
 
 // Ufs serves up a designted portion of the host file system.
 // This fs is primairly for tools or testing and not meant for produciton.
+//
+// Stats differ from the warp9 protocol in one field: the Muid of a
+// Dir served by ufs holds the object's link count, not a user id.
+// The host keeps no last modifier and Dir has no field, not even
+// ExtAttr, that reaches the wire for a link count. Clients that show
+// Muid as a user should use Nlink instead.
 package ufs
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -15,6 +22,7 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -23,23 +31,59 @@ import (
 
 type ufsFid struct {
 	path       string
+	root       string     // export root when attached
+	mu         sync.Mutex // guards file, which Shutdown may close
 	file       *os.File
 	dirs       []os.FileInfo
 	direntends []int
 	dirents    []byte
 	diroffset  uint64
 	st         os.FileInfo
+	ro         bool // fid belongs to a read-only snapshot view
 }
 
 type Ufs struct {
 	warp9.Srv
 	warp9.StatsOps
-	Root string
+	Root     string
+	ReadOnly bool     // refuse all modifications
+	Allow    []string // client addresses or CIDRs allowed to attach; empty allows all
+	SnapDir  string   // where snapshot views are staged; defaults to os.TempDir()
+	SnapMax  int64    // bytes of file data a snapshot may hold; 0 for DefaultSnapMax, <0 for no limit
+
+	cfgmu sync.RWMutex // guards Root, ReadOnly and Allow once started
+
+	snapmu sync.Mutex
+	snaps  map[*warp9.Conn][]*snapshot // snapshots held by each connection
+
+	drainmu  sync.Mutex
+	draining bool
+	inflight map[*warp9.SrvReq]bool // requests being worked on
+	files    map[*ufsFid]bool       // fids with an open host file
 }
 
+// toError converts a host error to a warp9 error. Rerror carries
+// only a code, so host errors become the matching warp9 code, or
+// EUFSerrno plus the errno when warp9 has none.
 func toError(err error) *warp9.WarpError {
-	// could convert err string to an id?
-	return warp9.ErrorMsg(warp9.Eio, err.Error())
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return warp9.ErrorMsg(warp9.Eio, err.Error())
+	}
+	code := EUFSerrno + int16(errno)
+	switch errno {
+	case syscall.EEXIST:
+		code = warp9.Eexist
+	case syscall.ENOENT:
+		code = warp9.Enotexist
+	case syscall.EPERM, syscall.EACCES:
+		code = warp9.Eperm
+	case syscall.ENOTDIR:
+		code = warp9.Enotdir
+	case syscall.ENOTEMPTY:
+		code = warp9.Enotempty
+	}
+	return warp9.ErrorMsg(code, err.Error())
 }
 
 // Error codes for UFS
@@ -54,6 +98,22 @@ const (
 	EUFSchown
 	EUFSrename
 	EUFStruncate
+	EUFSsnapshot
+	EUFSlink
+	EUFSaccess
+	EUFSshutdown
+)
+
+// EUFSerrno is added to host errnos that have no warp9 equivalent
+// (e.g. EUFSerrno+EXDEV for a link across filesystems).
+const EUFSerrno = 1000
+
+// DMLINK is set in the Create perm to make a hard link instead of a
+// new object. The name has the form "newname"+LinkSep+"target", where
+// target is an existing object in the export.
+const (
+	DMLINK  = 0x01000000
+	LinkSep = "->"
 )
 
 // IsBlock reports if the file is a block device
@@ -150,13 +210,16 @@ func dir2Dir(path string, d os.FileInfo, upool warp9.Users) (*warp9.Dir, error)
 	dir := new(ufsDir)
 	dir.Qid = *dir2Qid(d)
 	dir.Mode = dir2Npmode(d)
-	dir.Atime = 0 //uint32(sysMode.Atim)
+	dir.Atime = uint32(atime(sysMode).Unix())
 	dir.Mtime = uint32(d.ModTime().Unix())
 	dir.Length = uint64(d.Size())
 	dir.Name = path[strings.LastIndex(path, "/")+1:]
 
 	dir.Uid = sysMode.Uid
 	dir.Gid = sysMode.Gid
+	// Dir has no link count field and the host keeps no last
+	// modifier, so Muid carries the link count (see Nlink)
+	dir.Muid = uint32(sysMode.Nlink)
 
 	return &dir.Dir, nil
 }
@@ -167,13 +230,14 @@ func (*Ufs) ConnOpened(conn *warp9.Conn) {
 	}
 }
 
-func (*Ufs) ConnClosed(conn *warp9.Conn) {
+func (ufs *Ufs) ConnClosed(conn *warp9.Conn) {
 	if conn.Srv.Debuglevel > 0 {
 		log.Println("disconnected")
 	}
+	ufs.releaseSnapshots(conn)
 }
 
-func (*Ufs) FidDestroy(sfid *warp9.SrvFid) {
+func (u *Ufs) FidDestroy(sfid *warp9.SrvFid) {
 	var fid *ufsFid
 
 	if sfid.Aux == nil {
@@ -181,9 +245,13 @@ func (*Ufs) FidDestroy(sfid *warp9.SrvFid) {
 	}
 
 	fid = sfid.Aux.(*ufsFid)
+	u.untrackFile(fid)
+	fid.mu.Lock()
 	if fid.file != nil {
 		fid.file.Close()
+		fid.file = nil
 	}
+	fid.mu.Unlock()
 }
 
 func (ufs *Ufs) Attach(req *warp9.SrvReq) {
@@ -192,12 +260,49 @@ func (ufs *Ufs) Attach(req *warp9.SrvReq) {
 		return
 	}
 
+	cfg := ufs.config()
+	if !cfg.allowed(req.Conn.RemoteAddr()) {
+		req.RespondError(warp9.Error(EUFSaccess))
+		return
+	}
+
 	tc := req.Tc
 	fid := new(ufsFid)
 	// You can think of the ufs.Root as a 'chroot' of a sort.
 	// clients attach are not allowed to go outside the
-	// directory represented by ufs.Root
-	fid.path = path.Join(ufs.Root, tc.Aname)
+	// directory represented by ufs.Root. The fid and those walked
+	// from it keep that root across reconfiguration.
+	fid.path = path.Join(cfg.Root, tc.Aname)
+	fid.root = cfg.Root
+
+	// an aname of the form "snap:path" attaches to a frozen,
+	// read-only copy of path taken now.
+	if strings.HasPrefix(tc.Aname, SnapPrefix) {
+		// the copy follows a symlink at src, so resolve it first
+		src, e := realPath(path.Join(cfg.Root, tc.Aname[len(SnapPrefix):]))
+		if e != nil {
+			req.RespondError(toError(e))
+			return
+		}
+		in, e := inRoot(cfg.Root, src)
+		if e != nil {
+			req.RespondError(toError(e))
+			return
+		}
+		if !in {
+			req.RespondError(warp9.Error(warp9.Eperm))
+			return
+		}
+		snap, e := ufs.takeSnapshot(req.Conn, src)
+		if e != nil {
+			log.Printf("snapshot failed: %v\n", e)
+			req.RespondError(warp9.Error(EUFSsnapshot))
+			return
+		}
+		fid.path = snap.dir
+		fid.root = snap.dir
+		fid.ro = true
+	}
 
 	req.Fid.Aux = fid
 	err := fid.stat()
@@ -244,10 +349,12 @@ func (*Ufs) Walk(req *warp9.SrvReq) {
 	path = p
 
 	nfid.path = path
+	nfid.root = fid.root
+	nfid.ro = fid.ro
 	req.RespondRwalk(&wqid)
 }
 
-func (*Ufs) Open(req *warp9.SrvReq) {
+func (u *Ufs) Open(req *warp9.SrvReq) {
 	fid := req.Fid.Aux.(*ufsFid)
 	tc := req.Tc
 	err := fid.stat()
@@ -256,18 +363,30 @@ func (*Ufs) Open(req *warp9.SrvReq) {
 		return
 	}
 
+	if u.readOnly(fid) && (tc.Mode&3 == warp9.OWRITE || tc.Mode&3 == warp9.ORDWR || tc.Mode&warp9.OTRUNC != 0) {
+		req.RespondError(warp9.Error(warp9.Eperm))
+		return
+	}
+
+	fid.mu.Lock()
 	var e error
 	fid.file, e = os.OpenFile(fid.path, omode2uflags(tc.Mode), 0)
+	fid.mu.Unlock()
 	if e != nil {
 		req.RespondError(warp9.Error(EUFSopen))
 		return
 	}
+	u.trackFile(fid)
 
 	req.RespondRopen(dir2Qid(fid.st), 0)
 }
 
-func (*Ufs) Create(req *warp9.SrvReq) {
+func (u *Ufs) Create(req *warp9.SrvReq) {
 	fid := req.Fid.Aux.(*ufsFid)
+	if u.readOnly(fid) {
+		req.RespondError(warp9.Error(warp9.Eperm))
+		return
+	}
 	tc := req.Tc
 	err := fid.stat()
 	if err != nil {
@@ -275,10 +394,50 @@ func (*Ufs) Create(req *warp9.SrvReq) {
 		return
 	}
 
-	path := fid.path + "/" + tc.Name
+	name := tc.Name
+	var target string
+	if tc.Perm&DMLINK != 0 {
+		i := strings.Index(name, LinkSep)
+		if i <= 0 {
+			req.RespondError(warp9.Error(warp9.Ename))
+			return
+		}
+		name, target = name[:i], name[i+len(LinkSep):]
+
+		// target is relative to the export root if it starts
+		// with /, else relative to the directory being created in.
+		if target == "" || target[0] != '/' {
+			target = path.Join(fid.path, target)
+		} else {
+			target = path.Join(fid.root, target)
+		}
+		in, e := inRoot(fid.root, target)
+		if e != nil {
+			req.RespondError(toError(e))
+			return
+		}
+		if !in {
+			req.RespondError(warp9.Error(warp9.Eperm))
+			return
+		}
+	}
+
+	// the new object goes in this directory and nowhere else
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		req.RespondError(warp9.Error(warp9.Ename))
+		return
+	}
+
+	path := fid.path + "/" + name
 	var e error = nil
 	var file *os.File = nil
 	switch {
+	case tc.Perm&DMLINK != 0:
+		if e = os.Link(target, path); e != nil {
+			req.RespondError(toError(e))
+			return
+		}
+
 	case tc.Perm&warp9.DMDIR != 0:
 		e = os.Mkdir(path, os.FileMode(tc.Perm&0777))
 
@@ -297,7 +456,10 @@ func (*Ufs) Create(req *warp9.SrvReq) {
 	}
 
 	fid.path = path
+	fid.mu.Lock()
 	fid.file = file
+	fid.mu.Unlock()
+	u.trackFile(fid)
 	err = fid.stat()
 	if err != nil {
 		req.RespondError(err)
@@ -318,6 +480,26 @@ func (*Ufs) Read(req *warp9.SrvReq) {
 	}
 
 	rc.InitRread(tc.Count)
+	fid.mu.Lock()
+	count, err := fid.read(req)
+	fid.mu.Unlock()
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	rc.SetRreadCount(uint32(count))
+	req.Respond()
+}
+
+// read fills req.Rc.Data from the open file; fid.mu is held.
+func (fid *ufsFid) read(req *warp9.SrvReq) (int, *warp9.WarpError) {
+	tc := req.Tc
+	rc := req.Rc
+	if fid.file == nil {
+		return 0, warp9.Error(warp9.Enotopen)
+	}
+
 	var count int
 	var e error
 	if fid.st.IsDir() {
@@ -327,13 +509,11 @@ func (*Ufs) Read(req *warp9.SrvReq) {
 			// in most cases, just close and reopen it.
 			fid.file.Close()
 			if fid.file, e = os.OpenFile(fid.path, omode2uflags(req.Fid.Omode), 0); e != nil {
-				req.RespondError(warp9.Error(EUFSopen))
-				return
+				return 0, warp9.Error(EUFSopen)
 			}
 
 			if fid.dirs, e = fid.file.Readdir(-1); e != nil {
-				req.RespondError(warp9.Error(EUFSread))
-				return
+				return 0, warp9.Error(EUFSread)
 			}
 
 			fid.dirents = nil
@@ -365,18 +545,19 @@ func (*Ufs) Read(req *warp9.SrvReq) {
 	} else {
 		count, e = fid.file.ReadAt(rc.Data, int64(tc.Offset))
 		if e != nil && e != io.EOF {
-			req.RespondError(warp9.Error(EUFSread))
-			return
+			return 0, warp9.Error(EUFSread)
 		}
 
 	}
-
-	rc.SetRreadCount(uint32(count))
-	req.Respond()
+	return count, nil
 }
 
-func (*Ufs) Write(req *warp9.SrvReq) {
+func (u *Ufs) Write(req *warp9.SrvReq) {
 	fid := req.Fid.Aux.(*ufsFid)
+	if u.readOnly(fid) {
+		req.RespondError(warp9.Error(warp9.Eperm))
+		return
+	}
 	tc := req.Tc
 	err := fid.stat()
 	if err != nil {
@@ -384,7 +565,14 @@ func (*Ufs) Write(req *warp9.SrvReq) {
 		return
 	}
 
+	fid.mu.Lock()
+	if fid.file == nil {
+		fid.mu.Unlock()
+		req.RespondError(warp9.Error(warp9.Enotopen))
+		return
+	}
 	n, e := fid.file.WriteAt(tc.Data, int64(tc.Offset))
+	fid.mu.Unlock()
 	if e != nil {
 		req.RespondError(warp9.Error(EUFSwrite))
 		return
@@ -395,8 +583,12 @@ func (*Ufs) Write(req *warp9.SrvReq) {
 
 func (*Ufs) Clunk(req *warp9.SrvReq) { req.RespondRclunk() }
 
-func (*Ufs) Remove(req *warp9.SrvReq) {
+func (u *Ufs) Remove(req *warp9.SrvReq) {
 	fid := req.Fid.Aux.(*ufsFid)
+	if u.readOnly(fid) {
+		req.RespondError(warp9.Error(warp9.Eperm))
+		return
+	}
 	err := fid.stat()
 	if err != nil {
 		req.RespondError(err)
@@ -429,6 +621,27 @@ func (*Ufs) Stat(req *warp9.SrvReq) {
 	req.RespondRstat(st)
 }
 
+// inRoot reports if p lies within the tree at root once symlinks
+// are resolved. The last element of p is left alone: a link to a
+// symlink links the symlink, not what it points to.
+func inRoot(root, p string) (bool, error) {
+	r, err := realPath(root)
+	if err != nil {
+		return false, err
+	}
+	d, err := realPath(path.Dir(p))
+	if err != nil {
+		return false, err
+	}
+	return within(path.Join(d, path.Base(p)), r), nil
+}
+
+// Nlink returns the link count of an object served by ufs, which is
+// carried in the Muid field of its Dir.
+func Nlink(d *warp9.Dir) uint32 {
+	return d.Muid
+}
+
 func lookup(uid string, group bool) (uint32, *warp9.WarpError) {
 	if uid == "" {
 		return warp9.NOUID, nil
@@ -450,6 +663,10 @@ func lookup(uid string, group bool) (uint32, *warp9.WarpError) {
 
 func (u *Ufs) Wstat(req *warp9.SrvReq) {
 	fid := req.Fid.Aux.(*ufsFid)
+	if u.readOnly(fid) {
+		req.RespondError(warp9.Error(warp9.Eperm))
+		return
+	}
 	err := fid.stat()
 	if err != nil {
 		req.RespondError(err)
@@ -483,13 +700,20 @@ func (u *Ufs) Wstat(req *warp9.SrvReq) {
 		// cwd.
 		var destpath string
 		if dir.Name[0] == '/' {
-			destpath = path.Join(u.Root, dir.Name)
+			destpath = path.Join(fid.root, dir.Name)
 			fmt.Printf("/ results in %s\n", destpath)
 		} else {
 			fiddir, _ := path.Split(fid.path)
 			destpath = path.Join(fiddir, dir.Name)
 			fmt.Printf("rel  results in %s\n", destpath)
 		}
+		if in, e := inRoot(fid.root, destpath); e != nil {
+			req.RespondError(toError(e))
+			return
+		} else if !in {
+			req.RespondError(warp9.Error(warp9.Eperm))
+			return
+		}
 		err := syscall.Rename(fid.path, destpath)
 		fmt.Printf("rename %s to %s gets %v\n", fid.path, destpath, err)
 		if err != nil {
@@ -521,7 +745,7 @@ func (u *Ufs) Wstat(req *warp9.SrvReq) {
 			case true:
 				mt = st.ModTime()
 			default:
-				//at = time.Time(0)//atime(st.Sys().(*syscall.Stat_t))
+				at = atime(st.Sys().(*syscall.Stat_t))
 			}
 		}
 		e := os.Chtimes(fid.path, at, mt)
@@ -0,0 +1,248 @@
+// Copyright 2018 Larry Rau. All rights reserved
+// See Apache2 LICENSE
+
+package ufs
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lavaorg/warp/warp9"
+)
+
+// start serves u on a loopback port and returns its address.
+func start(t *testing.T, u *Ufs) string {
+	t.Helper()
+	u.Id = "ufs-test"
+	u.Start(u)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go u.StartListener(l)
+	return l.Addr().String()
+}
+
+func mount(t *testing.T, addr string) *warp9.Clnt {
+	t.Helper()
+	user := warp9.Identity.User(uint32(os.Getuid()))
+	c9, err := warp9.Mount("tcp", addr, "/", 8192, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c9.Unmount)
+	return c9
+}
+
+// serve starts u and mounts it.
+func serve(t *testing.T, u *Ufs) *warp9.Clnt {
+	t.Helper()
+	return mount(t, start(t, u))
+}
+
+// link makes name in the root a link to target. Clnt.Create would
+// take a / in target for a path separator.
+func link(c9 *warp9.Clnt, name, target string) error {
+	fid, err := c9.Walk("")
+	if err != nil {
+		return err
+	}
+	defer c9.Clunk(fid)
+	return c9.FCreate(fid, name+LinkSep+target, DMLINK|0644, warp9.OREAD, "")
+}
+
+func TestLink(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "a"), "data")
+	c9 := serve(t, &Ufs{Root: root})
+
+	if err := link(c9, "b", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(root, "b")); got != "data" {
+		t.Errorf("b = %q, want data", got)
+	}
+	for _, name := range []string{"a", "b"} {
+		d, err := c9.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := Nlink(d); n != 2 {
+			t.Errorf("%s: nlink %d, want 2", name, n)
+		}
+	}
+
+	if err := link(c9, "b", "a"); err == nil {
+		t.Errorf("link over existing name succeeded")
+	}
+}
+
+func TestToError(t *testing.T) {
+	for _, tc := range []struct {
+		errno syscall.Errno
+		code  int16
+	}{
+		{syscall.EEXIST, warp9.Eexist},
+		{syscall.ENOENT, warp9.Enotexist},
+		{syscall.EACCES, warp9.Eperm},
+		{syscall.EXDEV, EUFSerrno + int16(syscall.EXDEV)},
+	} {
+		err := &os.LinkError{Op: "link", Old: "a", New: "b", Err: tc.errno}
+		if got, want := toError(err), warp9.ErrorMsg(tc.code, err.Error()); !reflect.DeepEqual(got, want) {
+			t.Errorf("toError(%v) = %v, want %v", tc.errno, got, want)
+		}
+	}
+}
+
+func TestLinkOutsideRoot(t *testing.T) {
+	outside := t.TempDir()
+	writeFile(t, filepath.Join(outside, "secret"), "secret")
+	root := t.TempDir()
+	os.Symlink(outside, filepath.Join(root, "out"))
+	c9 := serve(t, &Ufs{Root: root})
+
+	for _, target := range []string{"../" + filepath.Base(outside) + "/secret", "out/secret", "/out/secret"} {
+		if err := link(c9, "x", target); err == nil {
+			t.Errorf("link to %s outside the root succeeded", target)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(root, "x")); err == nil {
+		t.Errorf("link outside the root was made")
+	}
+
+	// nor may the link itself be made outside it
+	writeFile(t, filepath.Join(root, "a"), "data")
+	for _, name := range []string{"../" + filepath.Base(outside) + "/x", "..", "sub/x"} {
+		if err := link(c9, name, "a"); err == nil {
+			t.Errorf("link named %s succeeded", name)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "x")); err == nil {
+		t.Errorf("link was made outside the root")
+	}
+
+	// a symlink inside the export may itself be linked
+	if err := link(c9, "y", "out"); err != nil {
+		t.Errorf("link to symlink: %v", err)
+	}
+}
+
+// wstat sends a Twstat for fid. It packs the message itself, as
+// Clnt.FWstat leaves the stat out of the message size.
+func wstat(c9 *warp9.Clnt, fid *warp9.Fid, d *warp9.Dir) error {
+	stat := warp9.PackDir(d)
+	pkt := make([]byte, 7+4+2+len(stat))
+	binary.LittleEndian.PutUint32(pkt, uint32(len(pkt)))
+	pkt[4] = warp9.Twstat // the tag is set by Rpc
+	binary.LittleEndian.PutUint32(pkt[7:], fid.Fid)
+	binary.LittleEndian.PutUint16(pkt[11:], uint16(len(stat)))
+	copy(pkt[13:], stat)
+	return rpc(c9, fid, pkt)
+}
+
+func rpc(c9 *warp9.Clnt, fid *warp9.Fid, pkt []byte) error {
+	tc := c9.NewFcall()
+	tc.Type, tc.Fid, tc.Pkt = pkt[4], fid.Fid, pkt
+	_, err := c9.Rpc(tc)
+	return err
+}
+
+// nullDir returns a Dir that leaves every field unchanged by Wstat.
+func nullDir() *warp9.Dir {
+	return &warp9.Dir{
+		Mode:   0xFFFFFFFF,
+		Atime:  ^uint32(0),
+		Mtime:  ^uint32(0),
+		Length: ^uint64(0),
+		Uid:    warp9.NOUID,
+		Gid:    warp9.NOUID,
+		Muid:   warp9.NOUID,
+	}
+}
+
+func TestWstat(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "a"), "data")
+	c9 := serve(t, &Ufs{Root: root})
+	fid, err := c9.Walk("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c9.Clunk(fid)
+
+	d := nullDir()
+	d.Mode = 0600
+	d.Atime, d.Mtime = 1000000000, 1100000000
+	if err := wstat(c9, fid, d); err != nil {
+		t.Fatal(err)
+	}
+	st, err := c9.FStat(fid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode&0777 != 0600 || st.Atime != d.Atime || st.Mtime != d.Mtime {
+		t.Errorf("got mode %o atime %d mtime %d, want %o %d %d", st.Mode&0777, st.Atime, st.Mtime, d.Mode, d.Atime, d.Mtime)
+	}
+
+	// changing mtime alone leaves atime be
+	d = nullDir()
+	d.Mtime = 1200000000
+	if err := wstat(c9, fid, d); err != nil {
+		t.Fatal(err)
+	}
+	if st, err = c9.FStat(fid); err != nil {
+		t.Fatal(err)
+	}
+	if st.Atime != 1000000000 || st.Mtime != d.Mtime {
+		t.Errorf("got atime %d mtime %d, want 1000000000 %d", st.Atime, st.Mtime, d.Mtime)
+	}
+
+	d = nullDir()
+	d.Name = "../escaped"
+	if err := wstat(c9, fid, d); err == nil {
+		t.Errorf("rename out of the root succeeded")
+	}
+	d.Name = "/b"
+	if err := wstat(c9, fid, d); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(root, "b")); got != "data" {
+		t.Errorf("b = %q, want data", got)
+	}
+}
+
+// A message warp9 can't unpack closes its connection, not the server.
+func TestMalformedMessage(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "a"), "data")
+	addr := start(t, &Ufs{Root: root})
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// a Twstat with the stat cut off, as Clnt.FWstat sends it
+	pkt := make([]byte, 7+4+2)
+	binary.LittleEndian.PutUint32(pkt, uint32(len(pkt)))
+	pkt[4] = warp9.Twstat
+	if _, err := c.Write(pkt); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := c.Read(pkt); err == nil {
+		t.Fatalf("malformed Twstat answered with %d bytes", n)
+	}
+
+	if _, err := mount(t, addr).Stat("a"); err != nil {
+		t.Error(err)
+	}
+}